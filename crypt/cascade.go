@@ -0,0 +1,57 @@
+package crypt
+
+import (
+	"fmt"
+)
+
+// cascade chains several ciphers, each with an independent key. Sectors are
+// encrypted with each cipher in turn and decrypted in the reverse order.
+type cascade []Cipher
+
+// registerCascade registers the cascade of the named ciphers under their
+// names joined by underscores. The cascade key is the concatenation of the
+// keys of each cipher. The named ciphers must already be registered.
+func registerCascade(names ...string) {
+	name, keySize := "", 0
+	for i, n := range names {
+		if i > 0 {
+			name += "_"
+		}
+		name += n
+		keySize += ciphers[n].keySize
+	}
+
+	Register(name, keySize, func(key []byte) (Cipher, error) {
+		var c cascade
+		for _, n := range names {
+			ci := ciphers[n]
+			cipher, err := ci.new(key[:ci.keySize])
+			if err != nil {
+				return nil, fmt.Errorf("Failed to create %q: %v", n, err)
+			}
+			c = append(c, cipher)
+			key = key[ci.keySize:]
+		}
+		return c, nil
+	})
+}
+
+// EncryptSector implements Cipher.
+func (c cascade) EncryptSector(dst, src []byte, sector uint64) {
+	for i, cipher := range c {
+		if i > 0 {
+			src = dst
+		}
+		cipher.EncryptSector(dst, src, sector)
+	}
+}
+
+// DecryptSector implements Cipher.
+func (c cascade) DecryptSector(dst, src []byte, sector uint64) {
+	for i := len(c) - 1; i >= 0; i-- {
+		if i < len(c)-1 {
+			src = dst
+		}
+		c[i].DecryptSector(dst, src, sector)
+	}
+}
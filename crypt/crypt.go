@@ -0,0 +1,91 @@
+// Package crypt provides the ciphers used to encrypt the sectors of a volume.
+package crypt
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"sort"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// SectorSize is the size in bytes of the units data is encrypted in.
+	SectorSize = 512
+
+	// kdfIterations is the number of PBKDF2 iterations used to derive keys
+	// from passphrases.
+	kdfIterations = 200000
+)
+
+// Cipher defines the interface for a sector cipher. Sectors are encrypted
+// independently using their sector number as a tweak, so any sector can be
+// rewritten without touching the rest of the volume.
+type Cipher interface {
+	// EncryptSector encrypts src into dst. src and dst may overlap and their
+	// length must be a multiple of 16.
+	EncryptSector(dst, src []byte, sector uint64)
+	// DecryptSector decrypts src into dst. src and dst may overlap and their
+	// length must be a multiple of 16.
+	DecryptSector(dst, src []byte, sector uint64)
+}
+
+// Constructor creates a new Cipher from key, which is always KeySize bytes.
+type Constructor func(key []byte) (Cipher, error)
+
+type cipherInfo struct {
+	keySize int
+	new     Constructor
+}
+
+var ciphers = map[string]cipherInfo{}
+
+// Register makes a cipher requiring keySize bytes of key material available
+// under the given name. Register is expected to be called from init and panics
+// if name is registered twice.
+func Register(name string, keySize int, c Constructor) {
+	if _, ok := ciphers[name]; ok {
+		panic(fmt.Errorf("Cipher %q registered twice", name))
+	}
+	ciphers[name] = cipherInfo{
+		keySize: keySize,
+		new:     c,
+	}
+}
+
+// New returns a new instance of the cipher registered under name.
+func New(name string, key []byte) (Cipher, error) {
+	ci, ok := ciphers[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown cipher %q, must be one of %v", name, Names())
+	}
+	if len(key) != ci.keySize {
+		return nil, fmt.Errorf("Cipher %q requires a %d byte key, got %d", name, ci.keySize, len(key))
+	}
+	return ci.new(key)
+}
+
+// KeySize returns the number of bytes of key material required by the cipher
+// registered under name.
+func KeySize(name string) (int, error) {
+	ci, ok := ciphers[name]
+	if !ok {
+		return 0, fmt.Errorf("Unknown cipher %q, must be one of %v", name, Names())
+	}
+	return ci.keySize, nil
+}
+
+// Names returns the sorted names of all registered ciphers.
+func Names() []string {
+	var names []string
+	for n := range ciphers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DeriveKey derives n bytes of key material from pass and salt.
+func DeriveKey(pass string, salt []byte, n int) []byte {
+	return pbkdf2.Key([]byte(pass), salt, kdfIterations, n, sha512.New)
+}
@@ -0,0 +1,163 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"testing"
+
+	"github.com/aead/serpent"
+	"golang.org/x/crypto/twofish"
+	"golang.org/x/crypto/xts"
+)
+
+// xtsVector is the XTS-AES-256 test vector of IEEE P1619/D16 Annex B, Vector
+// 10, a whole 512 byte sector.
+var xtsVector = struct {
+	key        string
+	sector     uint64
+	plaintext  string
+	ciphertext string
+}{
+	key: "2718281828459045235360287471352662497757247093699959574966967627" +
+		"3141592653589793238462643383279502884197169399375105820974944592",
+	sector: 0xff,
+	plaintext: "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f" +
+		"202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f" +
+		"404142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f" +
+		"606162636465666768696a6b6c6d6e6f707172737475767778797a7b7c7d7e7f" +
+		"808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f" +
+		"a0a1a2a3a4a5a6a7a8a9aaabacadaeafb0b1b2b3b4b5b6b7b8b9babbbcbdbebf" +
+		"c0c1c2c3c4c5c6c7c8c9cacbcccdcecfd0d1d2d3d4d5d6d7d8d9dadbdcdddedf" +
+		"e0e1e2e3e4e5e6e7e8e9eaebecedeeeff0f1f2f3f4f5f6f7f8f9fafbfcfdfeff" +
+		"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f" +
+		"202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f" +
+		"404142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f" +
+		"606162636465666768696a6b6c6d6e6f707172737475767778797a7b7c7d7e7f" +
+		"808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f" +
+		"a0a1a2a3a4a5a6a7a8a9aaabacadaeafb0b1b2b3b4b5b6b7b8b9babbbcbdbebf" +
+		"c0c1c2c3c4c5c6c7c8c9cacbcccdcecfd0d1d2d3d4d5d6d7d8d9dadbdcdddedf" +
+		"e0e1e2e3e4e5e6e7e8e9eaebecedeeeff0f1f2f3f4f5f6f7f8f9fafbfcfdfeff",
+	ciphertext: "1c3b3a102f770386e4836c99e370cf9bea00803f5e482357a4ae12d414a3e63b" +
+		"5d31e276f8fe4a8d66b317f9ac683f44680a86ac35adfc3345befecb4bb188fd" +
+		"5776926c49a3095eb108fd1098baec70aaa66999a72a82f27d848b21d4a741b0" +
+		"c5cd4d5fff9dac89aeba122961d03a757123e9870f8acf1000020887891429ca" +
+		"2a3e7a7d7df7b10355165c8b9a6d0a7de8b062c4500dc4cd120c0f7418dae3d0" +
+		"b5781c34803fa75421c790dfe1de1834f280d7667b327f6c8cd7557e12ac3a0f" +
+		"93ec05c52e0493ef31a12d3d9260f79a289d6a379bc70c50841473d1a8cc81ec" +
+		"583e9645e07b8d9670655ba5bbcfecc6dc3966380ad8fecb17b6ba02469a020a" +
+		"84e18e8f84252070c13e9f1f289be54fbc481457778f616015e1327a02b140f1" +
+		"505eb309326d68378f8374595c849d84f4c333ec4423885143cb47bd71c5edae" +
+		"9be69a2ffeceb1bec9de244fbe15992b11b77c040f12bd8f6a975a44a0f90c29" +
+		"a9abc3d4d893927284c58754cce294529f8614dcd2aba991925fedc4ae74ffac" +
+		"6e333b93eb4aff0479da9a410e4450e0dd7ae4c6e2910900575da401fc07059f" +
+		"645e8b7e9bfdef33943054ff84011493c27b3429eaedb4ed5376441a77ed4385" +
+		"1ad77f16f541dfd269d50d6a5f14fb0aab1cbb4c1550be97f7ab4066193c4caa" +
+		"773dad38014bd2092fa755c824bb5e54c4f36ffda9fcea70b9c6e693e148c151",
+}
+
+func fromHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// testKey returns n bytes of key material which differ between ciphers.
+func testKey(n int) []byte {
+	key := make([]byte, n)
+	for i := range key {
+		key[i] = byte(i*7 + 3)
+	}
+	return key
+}
+
+func TestAESKnownAnswer(t *testing.T) {
+	c, err := New("aes", fromHex(xtsVector.key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt, ct := fromHex(xtsVector.plaintext), fromHex(xtsVector.ciphertext)
+	got := make([]byte, len(pt))
+	c.EncryptSector(got, pt, xtsVector.sector)
+	if !bytes.Equal(got, ct) {
+		t.Fatalf("EncryptSector got %x, want %x", got, ct)
+	}
+	c.DecryptSector(got, got, xtsVector.sector)
+	if !bytes.Equal(got, pt) {
+		t.Fatalf("DecryptSector got %x, want %x", got, pt)
+	}
+}
+
+// xtsBlock returns the XTS mode cipher over block with key.
+func xtsBlock(t *testing.T, block func([]byte) (cipher.Block, error), key []byte) *xts.Cipher {
+	c, err := xts.NewCipher(block, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// TestCiphers checks each registered cipher against its underlying block
+// ciphers, so keys are split and cascades are applied in the documented
+// order.
+func TestCiphers(t *testing.T) {
+	blocks := map[string]func([]byte) (cipher.Block, error){
+		"aes": aes.NewCipher,
+		"twofish": func(key []byte) (cipher.Block, error) {
+			return twofish.NewCipher(key)
+		},
+		"serpent": serpent.NewCipher,
+	}
+	tests := []struct {
+		name  string
+		parts []string
+	}{
+		{"aes", []string{"aes"}},
+		{"twofish", []string{"twofish"}},
+		{"serpent", []string{"serpent"}},
+		{"aes_serpent_twofish", []string{"aes", "serpent", "twofish"}},
+	}
+	if len(tests) != len(Names()) {
+		t.Fatalf("Ciphers %v are not all tested", Names())
+	}
+	pt := fromHex(xtsVector.plaintext)
+	for _, test := range tests {
+		size, err := KeySize(test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != xtsKeySize*len(test.parts) {
+			t.Fatalf("%s: key size %d, want %d", test.name, size, xtsKeySize*len(test.parts))
+		}
+		key := testKey(size)
+		c, err := New(test.name, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := append([]byte{}, pt...)
+		for i, part := range test.parts {
+			xtsBlock(t, blocks[part], key[i*xtsKeySize:(i+1)*xtsKeySize]).Encrypt(want, want, 42)
+		}
+		got := make([]byte, len(pt))
+		c.EncryptSector(got, pt, 42)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: EncryptSector does not match its block ciphers", test.name)
+		}
+		c.DecryptSector(got, got, 42)
+		if !bytes.Equal(got, pt) {
+			t.Fatalf("%s: DecryptSector does not invert EncryptSector", test.name)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New("none", nil); err == nil {
+		t.Error("New of an unknown cipher did not fail")
+	}
+	if _, err := New("aes", make([]byte, 32)); err == nil {
+		t.Error("New with a short key did not fail")
+	}
+}
@@ -0,0 +1,98 @@
+package crypt
+
+import (
+	"fmt"
+	"io"
+)
+
+// ReadWriterAt is the storage encrypted by a Device.
+type ReadWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// Device encrypts everything written to an underlying device, sector by
+// sector. Unaligned accesses read, modify and rewrite the sectors they touch.
+// Device implements io.ReaderAt and io.WriterAt.
+type Device struct {
+	dev    ReadWriterAt
+	cipher Cipher
+	size   int64
+}
+
+// NewDevice returns a Device encrypting the first size bytes of dev with c.
+// size is rounded down to a whole number of sectors.
+func NewDevice(dev ReadWriterAt, size int64, c Cipher) *Device {
+	return &Device{
+		dev:    dev,
+		cipher: c,
+		size:   size - size%SectorSize,
+	}
+}
+
+// Size returns the size of the device in bytes.
+func (d *Device) Size() int64 {
+	return d.size
+}
+
+// ReadAt implements io.ReaderAt.
+func (d *Device) ReadAt(p []byte, off int64) (int, error) {
+	if err := d.checkRange(p, off); err != nil {
+		return 0, err
+	}
+	first, buf, err := d.readSectors(off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	return copy(p, buf[off-first*SectorSize:]), nil
+}
+
+// WriteAt implements io.WriterAt.
+func (d *Device) WriteAt(p []byte, off int64) (int, error) {
+	if err := d.checkRange(p, off); err != nil {
+		return 0, err
+	}
+	var (
+		first int64
+		buf   []byte
+		err   error
+	)
+	if off%SectorSize == 0 && len(p)%SectorSize == 0 {
+		first, buf = off/SectorSize, make([]byte, len(p))
+	} else if first, buf, err = d.readSectors(off, len(p)); err != nil {
+		return 0, err
+	}
+	copy(buf[off-first*SectorSize:], p)
+
+	for s := 0; s < len(buf)/SectorSize; s++ {
+		sector := buf[s*SectorSize : (s+1)*SectorSize]
+		d.cipher.EncryptSector(sector, sector, uint64(first+int64(s)))
+	}
+	if _, err := d.dev.WriteAt(buf, first*SectorSize); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// readSectors reads and decrypts the sectors covering n bytes at off. Returns
+// the number of the first sector and the decrypted data.
+func (d *Device) readSectors(off int64, n int) (int64, []byte, error) {
+	first := off / SectorSize
+	last := (off + int64(n) + SectorSize - 1) / SectorSize
+	buf := make([]byte, (last-first)*SectorSize)
+	if _, err := d.dev.ReadAt(buf, first*SectorSize); err != nil {
+		return 0, nil, err
+	}
+	for s := 0; s < len(buf)/SectorSize; s++ {
+		sector := buf[s*SectorSize : (s+1)*SectorSize]
+		d.cipher.DecryptSector(sector, sector, uint64(first+int64(s)))
+	}
+	return first, buf, nil
+}
+
+func (d *Device) checkRange(p []byte, off int64) error {
+	if off < 0 || off+int64(len(p)) > d.size {
+		return fmt.Errorf("Access of %d bytes at %d is outside of device size %d", len(p), off, d.size)
+	}
+	return nil
+}
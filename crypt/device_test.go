@@ -0,0 +1,105 @@
+package crypt
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// memDevice is an in memory ReadWriterAt.
+type memDevice []byte
+
+func (m memDevice) ReadAt(p []byte, off int64) (int, error) {
+	return copy(p, m[off:]), nil
+}
+
+func (m memDevice) WriteAt(p []byte, off int64) (int, error) {
+	return copy(m[off:], p), nil
+}
+
+// TestDeviceKnownAnswer writes the plaintext of xtsVector to its sector
+// through a Device and checks the underlying storage holds the ciphertext.
+func TestDeviceKnownAnswer(t *testing.T) {
+	c, err := New("aes", fromHex(xtsVector.key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := make(memDevice, 0x100*SectorSize)
+	d := NewDevice(mem, int64(len(mem)), c)
+	off := int64(xtsVector.sector) * SectorSize
+	pt, ct := fromHex(xtsVector.plaintext), fromHex(xtsVector.ciphertext)
+
+	// Write the sector in two unaligned halves, as well as in one.
+	if _, err := d.WriteAt(pt[:100], off); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.WriteAt(pt[100:], off+100); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mem[off:], ct) {
+		t.Fatalf("Device wrote %x, want %x", mem[off:], ct)
+	}
+	got := make([]byte, 300)
+	if _, err := d.ReadAt(got, off+50); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, pt[50:350]) {
+		t.Fatalf("ReadAt got %x, want %x", got, pt[50:350])
+	}
+}
+
+// TestDeviceRoundTrip makes unaligned reads and writes through a Device with
+// each cipher, checking them against a plaintext copy of the device and that
+// writes only change the sectors they touch.
+func TestDeviceRoundTrip(t *testing.T) {
+	for _, name := range Names() {
+		size, err := KeySize(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := New(name, testKey(size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mem := make(memDevice, 16*SectorSize+100)
+		d := NewDevice(mem, int64(len(mem)), c)
+		if d.Size() != 16*SectorSize {
+			t.Fatalf("%s: size %d is not rounded down to a whole sector", name, d.Size())
+		}
+		want := make([]byte, d.Size())
+		if _, err := d.WriteAt(want, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		r := rand.New(rand.NewSource(1))
+		for n := 0; n < 200; n++ {
+			off := r.Int63n(d.Size())
+			p := make([]byte, r.Int63n(d.Size()-off)+1)
+			r.Read(p)
+			before := append(memDevice{}, mem...)
+			if _, err := d.WriteAt(p, off); err != nil {
+				t.Fatalf("%s: write of %d bytes at %d: %v", name, len(p), off, err)
+			}
+			copy(want[off:], p)
+			first, end := off/SectorSize*SectorSize, (off+int64(len(p))+SectorSize-1)/SectorSize*SectorSize
+			if !bytes.Equal(mem[:first], before[:first]) || !bytes.Equal(mem[end:], before[end:]) {
+				t.Fatalf("%s: write of %d bytes at %d changed sectors outside of it", name, len(p), off)
+			}
+			if bytes.Contains(mem, p) && len(p) > 16 {
+				t.Fatalf("%s: write of %d bytes at %d stored plaintext", name, len(p), off)
+			}
+
+			off = r.Int63n(d.Size())
+			got := make([]byte, r.Int63n(d.Size()-off)+1)
+			if _, err := d.ReadAt(got, off); err != nil {
+				t.Fatalf("%s: read of %d bytes at %d: %v", name, len(got), off, err)
+			}
+			if !bytes.Equal(got, want[off:off+int64(len(got))]) {
+				t.Fatalf("%s: read of %d bytes at %d does not match", name, len(got), off)
+			}
+		}
+		if _, err := d.WriteAt(make([]byte, 2), d.Size()-1); err == nil {
+			t.Fatalf("%s: write past the end of the device did not fail", name)
+		}
+	}
+}
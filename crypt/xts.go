@@ -0,0 +1,49 @@
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+
+	"github.com/aead/serpent"
+	"golang.org/x/crypto/twofish"
+	"golang.org/x/crypto/xts"
+)
+
+// xtsKeySize is the key size of a 256 bit block cipher in XTS mode, which
+// needs both a data and a tweak key.
+const xtsKeySize = 64
+
+func init() {
+	Register("aes", xtsKeySize, newXTS(aes.NewCipher))
+	Register("twofish", xtsKeySize, newXTS(func(key []byte) (cipher.Block, error) {
+		return twofish.NewCipher(key)
+	}))
+	Register("serpent", xtsKeySize, newXTS(serpent.NewCipher))
+	registerCascade("aes", "serpent", "twofish")
+}
+
+// xtsCipher implements Cipher using XTS mode over a block cipher.
+type xtsCipher struct {
+	c *xts.Cipher
+}
+
+// newXTS returns a Constructor for a 256 bit block cipher in XTS mode.
+func newXTS(block func(key []byte) (cipher.Block, error)) Constructor {
+	return func(key []byte) (Cipher, error) {
+		c, err := xts.NewCipher(block, key)
+		if err != nil {
+			return nil, err
+		}
+		return &xtsCipher{c}, nil
+	}
+}
+
+// EncryptSector implements Cipher.
+func (x *xtsCipher) EncryptSector(dst, src []byte, sector uint64) {
+	x.c.Encrypt(dst, src, sector)
+}
+
+// DecryptSector implements Cipher.
+func (x *xtsCipher) DecryptSector(dst, src []byte, sector uint64) {
+	x.c.Decrypt(dst, src, sector)
+}
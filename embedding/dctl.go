@@ -0,0 +1,90 @@
+package embedding
+
+import (
+	"fmt"
+
+	"stegasis/video"
+)
+
+// dctBlockSize is the number of DCT coefficients in a block. Algorithms which
+// embed within DCT coefficients expect frames to expose their coefficients as
+// consecutive 8x8 blocks with the DC coefficient first, as jpeg.JPEG does.
+const dctBlockSize = 64
+
+func init() {
+	Register("dctl", newDCTL)
+}
+
+// dctl embeds sequentially in the least significant bit of the AC DCT
+// coefficients, in the style of JSteg. Coefficients equal to 0 or 1 are
+// skipped, flipping the LSB of any other value never produces a 0 or 1 so the
+// set of usable coefficients is unchanged by embedding.
+type dctl struct {
+	cap int
+}
+
+func newDCTL(opts Options) Algorithm {
+	return &dctl{
+		cap: opts.Cap,
+	}
+}
+
+// usableDCT returns true iff the jth element of a frame, holding val, is an AC
+// coefficient whose LSB can be used for embedding.
+func usableDCT(j, val int) bool {
+	return j%dctBlockSize != 0 && val != 0 && val != 1
+}
+
+// countUsableDCT returns the number of coefficients within f which pass
+// usableDCT.
+func countUsableDCT(f video.Frame) int {
+	usable := 0
+	for j := 0; j < f.Size(); j++ {
+		if usableDCT(j, f.GetElement(j)) {
+			usable++
+		}
+	}
+	return usable
+}
+
+// ElementType implements Algorithm.
+func (d *dctl) ElementType() video.ElementType {
+	return video.DCTCoefficients
+}
+
+// Capacity implements Algorithm.
+func (d *dctl) Capacity(i int, f video.Frame) int {
+	return countUsableDCT(f) * d.cap / 100
+}
+
+// ReadBits implements Algorithm.
+func (d *dctl) ReadBits(i int, f video.Frame, p []byte) error {
+	n := 0
+	for j := 0; j < f.Size() && n < len(p)*8; j++ {
+		if val := f.GetElement(j); usableDCT(j, val) {
+			setBit(p, n, val&1)
+			n++
+		}
+	}
+	if n < len(p)*8 {
+		return fmt.Errorf("Frame only holds %d of %d bits", n, len(p)*8)
+	}
+	return nil
+}
+
+// WriteBits implements Algorithm.
+func (d *dctl) WriteBits(i int, f video.Frame, p []byte) error {
+	n := 0
+	for j := 0; j < f.Size() && n < len(p)*8; j++ {
+		if val := f.GetElement(j); usableDCT(j, val) {
+			if val&1 != bit(p, n) {
+				f.SetElement(j, val^1)
+			}
+			n++
+		}
+	}
+	if n < len(p)*8 {
+		return fmt.Errorf("Frame only holds %d of %d bits", n, len(p)*8)
+	}
+	return nil
+}
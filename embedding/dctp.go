@@ -0,0 +1,87 @@
+package embedding
+
+import (
+	"fmt"
+
+	"stegasis/video"
+)
+
+func init() {
+	Register("dctp", newDCTP)
+}
+
+// dctp embeds in the same coefficients as dctl but visits both the
+// coefficients of a frame and the frames of the video in an order derived from
+// the key. This spreads modifications over the video rather than clustering
+// them in the first frames and blocks.
+//
+// Even frames are visited before odd frames, leaving the odd frames to a hidden
+// volume, see framePermutation. A volume holding less than half of its
+// capacity so modifies frames from across the whole video, though drawn from
+// only half of them.
+type dctp struct {
+	key   []byte
+	cap   int
+	perms *permutationCache
+}
+
+func newDCTP(opts Options) Algorithm {
+	return &dctp{
+		key:   opts.Key,
+		cap:   opts.Cap,
+		perms: newPermutationCache(opts.Key),
+	}
+}
+
+// FrameOrder implements FrameOrderer.
+func (d *dctp) FrameOrder(n int) []int {
+	return framePermutation(d.key, n)
+}
+
+// ElementType implements Algorithm.
+func (d *dctp) ElementType() video.ElementType {
+	return video.DCTCoefficients
+}
+
+// Capacity implements Algorithm.
+func (d *dctp) Capacity(i int, f video.Frame) int {
+	return countUsableDCT(f) * d.cap / 100
+}
+
+// ReadBits implements Algorithm.
+func (d *dctp) ReadBits(i int, f video.Frame, p []byte) error {
+	n := 0
+	for _, j := range d.perms.get(f.Size()) {
+		if n == len(p)*8 {
+			break
+		}
+		if val := f.GetElement(j); usableDCT(j, val) {
+			setBit(p, n, val&1)
+			n++
+		}
+	}
+	if n < len(p)*8 {
+		return fmt.Errorf("Frame only holds %d of %d bits", n, len(p)*8)
+	}
+	return nil
+}
+
+// WriteBits implements Algorithm.
+func (d *dctp) WriteBits(i int, f video.Frame, p []byte) error {
+	n := 0
+	for _, j := range d.perms.get(f.Size()) {
+		if n == len(p)*8 {
+			break
+		}
+		if val := f.GetElement(j); usableDCT(j, val) {
+			if val&1 != bit(p, n) {
+				f.SetElement(j, val^1)
+			}
+			n++
+		}
+	}
+	if n < len(p)*8 {
+		return fmt.Errorf("Frame only holds %d of %d bits", n, len(p)*8)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package embedding
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"stegasis/video"
+)
+
+// Device provides byte addressable access to the data embedded within the
+// frames of a codec, hiding how bytes map onto frame elements. Each frame
+// holds its own number of bytes, given by a capacity map, and frames are
+// filled in the order given by FrameOrder. Device implements io.ReaderAt and
+// io.WriterAt.
+type Device struct {
+	codec video.Codec
+	alg   Algorithm
+	// sizes holds the number of bytes stored in each frame.
+	sizes []int
+	order []int
+	// starts holds the offset of each frame in the order they are visited,
+	// followed by the size of the device.
+	starts []int64
+}
+
+// NewDevice returns a Device storing sizes[i] bytes in frame i of codec using
+// alg.
+func NewDevice(codec video.Codec, alg Algorithm, sizes []int) *Device {
+	d := &Device{
+		codec:  codec,
+		alg:    alg,
+		sizes:  sizes,
+		order:  FrameOrder(alg, codec.Frames()),
+		starts: make([]int64, codec.Frames()+1),
+	}
+	for k, i := range d.order {
+		d.starts[k+1] = d.starts[k] + int64(sizes[i])
+	}
+	return d
+}
+
+// FrameSizes returns the number of bytes each frame of codec can hold using
+// alg, which varies with the content of the frame.
+func FrameSizes(codec video.Codec, alg Algorithm) ([]int, error) {
+	sizes := make([]int, codec.Frames())
+	for i := range sizes {
+		f, err := codec.GetFrame(i)
+		if err != nil {
+			return nil, err
+		}
+		sizes[i] = alg.Capacity(i, f) / 8
+	}
+	return sizes, nil
+}
+
+// Size returns the total number of bytes the device can hold.
+func (d *Device) Size() int64 {
+	return d.starts[len(d.starts)-1]
+}
+
+// ReadAt implements io.ReaderAt.
+func (d *Device) ReadAt(p []byte, off int64) (int, error) {
+	if err := d.checkRange(p, off); err != nil {
+		return 0, err
+	}
+	read := 0
+	for read < len(p) {
+		i, start, n := d.locate(off+int64(read), len(p)-read)
+		f, err := d.codec.GetFrame(i)
+		if err != nil {
+			return read, err
+		}
+		buf := make([]byte, start+n)
+		if err := d.alg.ReadBits(i, f, buf); err != nil {
+			return read, fmt.Errorf("Failed to read frame %d: %v", i, err)
+		}
+		read += copy(p[read:], buf[start:])
+	}
+	return read, nil
+}
+
+// WriteAt implements io.WriterAt. Frames are always rewritten in full as
+// some algorithms cannot modify part of a frame in isolation, writes which
+// cover a whole frame do not need to read it first.
+func (d *Device) WriteAt(p []byte, off int64) (int, error) {
+	if err := d.checkRange(p, off); err != nil {
+		return 0, err
+	}
+	written := 0
+	for written < len(p) {
+		i, start, n := d.locate(off+int64(written), len(p)-written)
+		f, err := d.codec.GetFrame(i)
+		if err != nil {
+			return written, err
+		}
+		if n == d.sizes[i] {
+			if err := d.alg.WriteBits(i, f, p[written:written+n]); err != nil {
+				return written, fmt.Errorf("Failed to write frame %d: %v", i, err)
+			}
+			written += n
+			continue
+		}
+
+		buf := make([]byte, d.sizes[i])
+		if err := d.alg.ReadBits(i, f, buf); err != nil {
+			return written, fmt.Errorf("Failed to read frame %d: %v", i, err)
+		}
+		if !bytes.Equal(buf[start:start+n], p[written:written+n]) {
+			copy(buf[start:], p[written:written+n])
+			if err := d.alg.WriteBits(i, f, buf); err != nil {
+				return written, fmt.Errorf("Failed to write frame %d: %v", i, err)
+			}
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Frames returns the frames holding the n bytes at off, in the order they are
+// visited.
+func (d *Device) Frames(off, n int64) []int {
+	var frames []int
+	for k := d.position(off); k < len(d.order) && d.starts[k] < off+n; k++ {
+		if d.sizes[d.order[k]] > 0 {
+			frames = append(frames, d.order[k])
+		}
+	}
+	return frames
+}
+
+// position returns the position in the visiting order of the frame holding the
+// byte at off.
+func (d *Device) position(off int64) int {
+	return sort.Search(len(d.order), func(k int) bool {
+		return d.starts[k+1] > off
+	})
+}
+
+// locate returns the frame holding the byte at off, the offset of that byte
+// within the frame and how many of the following n bytes lie within the frame.
+func (d *Device) locate(off int64, n int) (int, int, int) {
+	k := d.position(off)
+	i := d.order[k]
+	start := int(off - d.starts[k])
+	if start+n > d.sizes[i] {
+		n = d.sizes[i] - start
+	}
+	return i, start, n
+}
+
+func (d *Device) checkRange(p []byte, off int64) error {
+	if off < 0 || off+int64(len(p)) > d.Size() {
+		return fmt.Errorf("Access of %d bytes at %d is outside of device size %d", len(p), off, d.Size())
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package embedding
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"stegasis/video"
+	"stegasis/video/videotest"
+)
+
+// TestDevice writes and reads ranges which start and end part way through
+// frames and span several frames, checking the device against a copy of its
+// contents. Algorithms which shrink coefficients use a lower Cap so frames
+// survive being rewritten by every write.
+func TestDevice(t *testing.T) {
+	for _, name := range Names() {
+		cap := 50
+		if shrinks(name) {
+			cap = 10
+		}
+		alg, err := New(name, Options{Key: []byte("key"), Cap: cap})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := videotest.NewCodec(1, video.DCTCoefficients, videotest.Sizes(8, 3200)...)
+		sizes, err := FrameSizes(c, alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := NewDevice(c, alg, sizes)
+		r := rand.New(rand.NewSource(6))
+		want := randomBytes(r, int(d.Size()))
+		if _, err := d.WriteAt(want, 0); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for n := 0; n < 50; n++ {
+			off := r.Int63n(d.Size())
+			p := randomBytes(r, r.Intn(int(d.Size()-off))+1)
+			if _, err := d.WriteAt(p, off); err != nil {
+				t.Fatalf("%s: write of %d bytes at %d: %v", name, len(p), off, err)
+			}
+			copy(want[off:], p)
+		}
+		got := make([]byte, d.Size())
+		if _, err := d.ReadAt(got, 0); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: device does not hold the data written", name)
+		}
+		if _, err := d.ReadAt(make([]byte, 2), d.Size()-1); err == nil {
+			t.Fatalf("%s: read past the end of the device did not fail", name)
+		}
+	}
+}
+
+// TestFrameSpread checks every algorithm visits the even frames first, leaving
+// the odd frames to a hidden volume, and that keyed algorithms spread a device
+// a quarter full over the whole video.
+func TestFrameSpread(t *testing.T) {
+	const frames = 64
+	for _, name := range Names() {
+		alg, err := New(name, Options{Key: []byte("key"), Cap: 50})
+		if err != nil {
+			t.Fatal(err)
+		}
+		order := FrameOrder(alg, frames)
+		if order[0] != 0 {
+			t.Fatalf("%s: first frame visited is %d", name, order[0])
+		}
+		for k, i := range order {
+			if (k < frames/2) != (i%2 == 0) {
+				t.Fatalf("%s: frame %d visited at position %d", name, i, k)
+			}
+		}
+		if _, ok := alg.(FrameOrderer); !ok {
+			continue
+		}
+
+		c := videotest.NewCodec(1, video.DCTCoefficients, videotest.Sizes(frames, 640)...)
+		sizes, err := FrameSizes(c, alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := NewDevice(c, alg, sizes)
+		first, last := false, false
+		for _, i := range d.Frames(0, d.Size()/4) {
+			first = first || i < frames/4
+			last = last || i >= frames*3/4
+		}
+		if !first || !last {
+			t.Errorf("%s: a quarter full device does not span the video", name)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Package embedding provides the steganographic algorithms which hide data
+// within the elements of video frames.
+package embedding
+
+import (
+	"fmt"
+	"sort"
+
+	"stegasis/video"
+)
+
+// Algorithm defines the interface for an embedding algorithm. Algorithms are
+// given the index of the frame within the video alongside the frame itself so
+// keyed algorithms can vary their behaviour per frame.
+//
+// Bits embedded at the start of a frame must be readable without knowing the
+// Cap the algorithm was created with, this allows the volume header to be read
+// before the rest of the volume options are known.
+type Algorithm interface {
+	// ElementType returns the type of frame element the algorithm embeds
+	// within.
+	ElementType() video.ElementType
+	// Capacity returns the number of bits which can be embedded within f.
+	Capacity(i int, f video.Frame) int
+	// ReadBits extracts the first len(p)*8 bits embedded within f into p, most
+	// significant bit first.
+	ReadBits(i int, f video.Frame, p []byte) error
+	// WriteBits embeds the len(p)*8 bits of p at the start of f, most
+	// significant bit first.
+	WriteBits(i int, f video.Frame, p []byte) error
+}
+
+// Options holds the options used to create an Algorithm.
+type Options struct {
+	// Key is derived from the passphrase and is used by algorithms which
+	// permute their embedding order.
+	Key []byte
+	// Cap is the percentage of each frame to embed within.
+	Cap int
+}
+
+// Constructor creates a new instance of an Algorithm.
+type Constructor func(opts Options) Algorithm
+
+var algorithms = map[string]Constructor{}
+
+// Register makes an algorithm available under the given name. Register is
+// expected to be called from init and panics if name is registered twice.
+func Register(name string, c Constructor) {
+	if _, ok := algorithms[name]; ok {
+		panic(fmt.Errorf("Embedding algorithm %q registered twice", name))
+	}
+	algorithms[name] = c
+}
+
+// New returns a new instance of the algorithm registered under name.
+func New(name string, opts Options) (Algorithm, error) {
+	c, ok := algorithms[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown embedding algorithm %q, must be one of %v", name, Names())
+	}
+	if opts.Cap <= 0 || opts.Cap > 100 {
+		return nil, fmt.Errorf("Capacity must be between 1 and 100 percent, got %d", opts.Cap)
+	}
+	return c(opts), nil
+}
+
+// Names returns the sorted names of all registered algorithms.
+func Names() []string {
+	var names []string
+	for n := range algorithms {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// bit returns the ith bit of p, counting from the most significant bit of the
+// first byte.
+func bit(p []byte, i int) int {
+	return int(p[i/8]>>uint(7-i%8)) & 1
+}
+
+// setBit sets the ith bit of p to b.
+func setBit(p []byte, i, b int) {
+	mask := byte(1) << uint(7-i%8)
+	if b == 0 {
+		p[i/8] &^= mask
+	} else {
+		p[i/8] |= mask
+	}
+}
@@ -0,0 +1,193 @@
+package embedding
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"stegasis/video/videotest"
+)
+
+// shrinks returns true iff the algorithm registered under name may shrink
+// coefficients to zero, so frames hold less as they are rewritten.
+func shrinks(name string) bool {
+	return name == "f4" || name == "f5"
+}
+
+// randomBytes returns n bytes from r.
+func randomBytes(r *rand.Rand, n int) []byte {
+	p := make([]byte, n)
+	r.Read(p)
+	return p
+}
+
+// TestRoundTrip writes random data to the same frame repeatedly with each
+// algorithm, reading it back after every write. The volume layout is fixed
+// when the volume is formatted so frames must keep holding their capacity as
+// they are rewritten, however often that is.
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		alg      string
+		cap      int
+		rewrites int
+	}{
+		{"lsb", 100, 100},
+		{"lsb", 50, 100},
+		{"lsbp", 100, 100},
+		{"lsbp", 50, 100},
+		{"dctl", 100, 100},
+		{"dctl", 50, 100},
+		{"dctp", 100, 100},
+		{"dctp", 50, 100},
+		{"f4", 100, 300},
+		{"f4", 40, 300},
+		{"f5", 100, 300},
+		{"f5", 40, 300},
+	}
+	for _, test := range tests {
+		alg, err := New(test.alg, Options{Key: []byte("key"), Cap: test.cap})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := videotest.NewDCTFrame(rand.New(rand.NewSource(1)), 25600, 6)
+		size := alg.Capacity(0, f) / 8
+		if size == 0 {
+			t.Fatalf("%s cap %d: frame has no capacity", test.alg, test.cap)
+		}
+		r := rand.New(rand.NewSource(2))
+		for n := 0; n < test.rewrites; n++ {
+			p := randomBytes(r, size)
+			if err := alg.WriteBits(0, f, p); err != nil {
+				t.Fatalf("%s cap %d: write %d: %v", test.alg, test.cap, n, err)
+			}
+			got := make([]byte, size)
+			if err := alg.ReadBits(0, f, got); err != nil {
+				t.Fatalf("%s cap %d: read %d: %v", test.alg, test.cap, n, err)
+			}
+			if !bytes.Equal(got, p) {
+				t.Fatalf("%s cap %d: read %d does not match write", test.alg, test.cap, n)
+			}
+			if c := alg.Capacity(0, f) / 8; c != size && !shrinks(test.alg) {
+				t.Fatalf("%s cap %d: capacity changed from %d to %d bytes after write %d", test.alg, test.cap, size, c, n)
+			}
+		}
+	}
+}
+
+// TestShrinkage checks F4 and F5 only ever decrement the absolute value of
+// coefficients until a frame has worn too far to hold a write, after which
+// coefficients never shrink to zero and writes keep fitting.
+func TestShrinkage(t *testing.T) {
+	for _, name := range []string{"f4", "f5"} {
+		alg, err := New(name, Options{Key: []byte("key"), Cap: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := videotest.NewDCTFrame(rand.New(rand.NewSource(7)), 6400, 3)
+		size := alg.Capacity(0, f) / 8
+		r := rand.New(rand.NewSource(8))
+		shrunk, worn := false, false
+		for n := 0; n < 300; n++ {
+			before := append([]int(nil), f.Elems...)
+			if err := alg.WriteBits(0, f, randomBytes(r, size)); err != nil {
+				t.Fatalf("%s: write %d: %v", name, n, err)
+			}
+			for j, val := range f.Elems {
+				switch {
+				case decremented(before[j], val):
+					if before[j] != 0 && val == 0 {
+						if worn {
+							t.Fatalf("%s: write %d shrank coefficient %d after the frame wore", name, n, j)
+						}
+						shrunk = true
+					}
+				case val == before[j]*2 && (val == 2 || val == -2):
+					worn = true
+				default:
+					t.Fatalf("%s: write %d changed coefficient %d from %d to %d", name, n, j, before[j], val)
+				}
+			}
+		}
+		if !shrunk || !worn {
+			t.Errorf("%s: frame never wore, shrunk %v", name, shrunk)
+		}
+	}
+}
+
+// decremented returns true iff after is before or before with its absolute
+// value decremented.
+func decremented(before, after int) bool {
+	switch {
+	case before > 0:
+		return after == before || after == before-1
+	case before < 0:
+		return after == before || after == before+1
+	}
+	return after == 0
+}
+
+// TestReadStart checks the start of a frame can be read by an algorithm
+// created without the Cap the frame was written with, as the volume header is.
+func TestReadStart(t *testing.T) {
+	for _, name := range Names() {
+		r := rand.New(rand.NewSource(3))
+		f := videotest.NewDCTFrame(rand.New(rand.NewSource(4)), 25600, 6)
+		alg, err := New(name, Options{Key: []byte("key"), Cap: 30})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := randomBytes(r, alg.Capacity(0, f)/8)
+		if err := alg.WriteBits(0, f, p); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		full, err := New(name, Options{Key: []byte("key"), Cap: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, 64)
+		if err := full.ReadBits(0, f, got); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(got, p[:len(got)]) {
+			t.Fatalf("%s: start of frame does not match", name)
+		}
+	}
+}
+
+// TestWriteTooLarge checks the algorithms other than lsb refuse more data than
+// a frame can hold, including any data at all for an empty frame.
+func TestWriteTooLarge(t *testing.T) {
+	for _, name := range []string{"lsbp", "dctl", "dctp", "f4", "f5"} {
+		alg, err := New(name, Options{Key: []byte("key"), Cap: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := videotest.NewDCTFrame(rand.New(rand.NewSource(5)), 640, 6)
+		// Every bit needs a coefficient of its own.
+		p := make([]byte, f.Size()/8+1)
+		if err := alg.WriteBits(0, f, p); err == nil {
+			t.Errorf("%s: write of %d bytes to a frame of %d coefficients did not fail", name, len(p), f.Size())
+		}
+		if shrinks(name) && f.IsDirty() {
+			t.Errorf("%s: failed write modified the frame", name)
+		}
+		empty := &videotest.Frame{}
+		if err := alg.ReadBits(0, empty, make([]byte, 1)); err == nil {
+			t.Errorf("%s: read from an empty frame did not fail", name)
+		}
+		if err := alg.WriteBits(0, empty, make([]byte, 1)); err == nil {
+			t.Errorf("%s: write to an empty frame did not fail", name)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New("none", Options{Cap: 100}); err == nil {
+		t.Error("New of an unknown algorithm did not fail")
+	}
+	for _, cap := range []int{-1, 0, 101} {
+		if _, err := New("lsb", Options{Cap: cap}); err == nil {
+			t.Errorf("New with cap %d did not fail", cap)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package embedding
+
+import (
+	"fmt"
+
+	"stegasis/video"
+)
+
+func init() {
+	Register("f4", newF4)
+}
+
+// f4 implements Westfeld's F4 algorithm. Every non-zero AC coefficient holds
+// one bit: odd positive and even negative coefficients represent a 1, even
+// positive and odd negative coefficients a 0. A bit is embedded by decrementing
+// the absolute value of the coefficient, which keeps the coefficient histogram
+// shaped like that of an unmodified JPEG. If a coefficient shrinks to zero the
+// bit is lost and is embedded again in the next coefficient.
+//
+// Shrinkage means the number of bits a frame holds depends on the data written
+// and falls as the frame is rewritten, yet the volume records the capacity of
+// each frame when it is formatted and the filesystem rewrites the frames
+// holding its metadata on every checkpoint. Capacity only counts coefficients
+// which cannot shrink on the next write and a write which no longer fits once a
+// frame has worn is embedded without shrinkage instead: coefficients of
+// magnitude one which need flipping are incremented to two. No write leaves
+// fewer non zero coefficients than the bits it embedded, so a frame always
+// holds its recorded capacity however often it is rewritten. Incrementing
+// distorts the histogram more than decrementing does, a lower Cap leaves more
+// room for shrinkage and so delays it.
+type f4 struct {
+	cap int
+}
+
+func newF4(opts Options) Algorithm {
+	return &f4{
+		cap: opts.Cap,
+	}
+}
+
+// f4Usable returns true iff the jth element of a frame, holding val, is a non
+// zero AC coefficient and so holds a bit.
+func f4Usable(j, val int) bool {
+	return j%dctBlockSize != 0 && val != 0
+}
+
+// f4Bit returns the bit held by the non zero coefficient val.
+func f4Bit(val int) int {
+	if val < 0 {
+		return 1 - (-val)&1
+	}
+	return val & 1
+}
+
+// f4Decrement returns val with its absolute value decremented, which flips the
+// bit it holds unless it shrinks to zero.
+func f4Decrement(val int) int {
+	if val < 0 {
+		return val + 1
+	}
+	return val - 1
+}
+
+// f4Flip returns val changed to hold the opposite bit. Unless shrink is set
+// coefficients of magnitude one are incremented rather than decremented, so
+// the result is never zero.
+func f4Flip(val int, shrink bool) int {
+	if !shrink && (val == 1 || val == -1) {
+		return val * 2
+	}
+	return f4Decrement(val)
+}
+
+// f4Capacity returns the number of bits f holds whatever shrinkage occurs as
+// it is next written. Coefficients of magnitude one may shrink to zero so only
+// coefficients of magnitude two or more are counted.
+func f4Capacity(f video.Frame) int {
+	n := 0
+	for j := 0; j < f.Size(); j++ {
+		if val := f.GetElement(j); f4Usable(j, val) && val != 1 && val != -1 {
+			n++
+		}
+	}
+	return n
+}
+
+// ElementType implements Algorithm.
+func (a *f4) ElementType() video.ElementType {
+	return video.DCTCoefficients
+}
+
+// Capacity implements Algorithm.
+func (a *f4) Capacity(i int, f video.Frame) int {
+	return f4Capacity(f) * a.cap / 100
+}
+
+// ReadBits implements Algorithm.
+func (a *f4) ReadBits(i int, f video.Frame, p []byte) error {
+	n := 0
+	for j := 0; j < f.Size() && n < len(p)*8; j++ {
+		if val := f.GetElement(j); f4Usable(j, val) {
+			setBit(p, n, f4Bit(val))
+			n++
+		}
+	}
+	if n < len(p)*8 {
+		return fmt.Errorf("Frame only holds %d of %d bits", n, len(p)*8)
+	}
+	return nil
+}
+
+// WriteBits implements Algorithm. p is embedded without shrinkage if it no
+// longer fits otherwise, the frame is left unmodified if it cannot hold p
+// either way.
+func (a *f4) WriteBits(i int, f video.Frame, p []byte) error {
+	changes, n := f4Embed(f, p, true)
+	if n < len(p)*8 {
+		changes, n = f4Embed(f, p, false)
+	}
+	if n < len(p)*8 {
+		return fmt.Errorf("Frame only holds %d of %d bits", n, len(p)*8)
+	}
+	for j, val := range changes {
+		f.SetElement(j, val)
+	}
+	return nil
+}
+
+// f4Embed embeds p within f, flipping coefficients as f4Flip does, and returns
+// the modified coefficients without applying them to f along with the number
+// of bits of p which fit.
+func f4Embed(f video.Frame, p []byte, shrink bool) (map[int]int, int) {
+	changes := make(map[int]int)
+	n := 0
+	for j := 0; j < f.Size() && n < len(p)*8; j++ {
+		val := f.GetElement(j)
+		if !f4Usable(j, val) {
+			continue
+		}
+		if f4Bit(val) != bit(p, n) {
+			val = f4Flip(val, shrink)
+			changes[j] = val
+			if val == 0 {
+				// Shrinkage, the bit is embedded in the next coefficient.
+				continue
+			}
+		}
+		n++
+	}
+	return changes, n
+}
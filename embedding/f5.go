@@ -0,0 +1,242 @@
+package embedding
+
+import (
+	"fmt"
+
+	"stegasis/video"
+)
+
+const (
+	// f5StatusBits is the number of bits at the start of each frame which hold
+	// the k the rest of the frame was embedded with.
+	f5StatusBits = 8
+	f5MaxK       = 7
+)
+
+func init() {
+	Register("f5", newF5)
+}
+
+// f5 implements Westfeld's F5 algorithm. Coefficients are visited in an order
+// derived from the key (permutative straddling) and hold bits as in F4, but
+// data is embedded using a (1, 2^k-1, k) Hamming code: k bits are embedded
+// within a group of 2^k-1 non zero coefficients by decrementing at most one of
+// them as F4 does. If that coefficient shrinks to zero it no longer belongs to
+// the group, the next coefficient takes its place and the group is embedded
+// again. k is chosen per frame as the largest value which still fits the data
+// and is stored, F4 embedded, in the first f5StatusBits coefficients.
+//
+// Capacity is the number of bits which fit with k = 1 whatever shrinkage
+// occurs, embedding less than that, by lowering Cap, lets a larger k be chosen
+// which modifies fewer coefficients per bit. As with F4 frames wear as they are
+// rewritten and a frame which no longer fits its data is embedded without
+// shrinkage, see f4. A write using k coefficients per group uses at least as
+// many coefficients as k = 1 would, so a worn frame always holds its recorded
+// capacity.
+type f5 struct {
+	key   []byte
+	cap   int
+	perms *permutationCache
+}
+
+func newF5(opts Options) Algorithm {
+	return &f5{
+		key:   opts.Key,
+		cap:   opts.Cap,
+		perms: newPermutationCache(opts.Key),
+	}
+}
+
+// f5Iterator visits the non zero AC coefficients of a frame in permuted order.
+// Coefficients are read through changes, which holds the coefficients modified
+// by an embedding not yet applied to the frame.
+type f5Iterator struct {
+	f       video.Frame
+	perm    []int
+	pos     int
+	changes map[int]int
+}
+
+// get returns the jth coefficient of the frame.
+func (it *f5Iterator) get(j int) int {
+	if val, ok := it.changes[j]; ok {
+		return val
+	}
+	return it.f.GetElement(j)
+}
+
+// next returns the index of the next non zero AC coefficient, or -1 if there
+// are none left.
+func (it *f5Iterator) next() int {
+	for it.pos < len(it.perm) {
+		j := it.perm[it.pos]
+		it.pos++
+		if f4Usable(j, it.get(j)) {
+			return j
+		}
+	}
+	return -1
+}
+
+// hash returns the k bit value held by a group of coefficients, the XOR of the
+// 1 based positions of every coefficient holding a 1.
+func (it *f5Iterator) hash(group []int) int {
+	h := 0
+	for g, j := range group {
+		if f4Bit(it.get(j)) == 1 {
+			h ^= g + 1
+		}
+	}
+	return h
+}
+
+// FrameOrder implements FrameOrderer.
+func (a *f5) FrameOrder(n int) []int {
+	return framePermutation(a.key, n)
+}
+
+// ElementType implements Algorithm.
+func (a *f5) ElementType() video.ElementType {
+	return video.DCTCoefficients
+}
+
+// Capacity implements Algorithm.
+func (a *f5) Capacity(i int, f video.Frame) int {
+	n := f4Capacity(f) - f5StatusBits
+	if n < 0 {
+		return 0
+	}
+	return n * a.cap / 100
+}
+
+// f5Usable returns the number of coefficients of f available for data once the
+// status has been embedded, if none of them shrink.
+func f5Usable(f video.Frame) int {
+	usable := -f5StatusBits
+	for j := 0; j < f.Size(); j++ {
+		if f4Usable(j, f.GetElement(j)) {
+			usable++
+		}
+	}
+	return usable
+}
+
+// ReadBits implements Algorithm.
+func (a *f5) ReadBits(i int, f video.Frame, p []byte) error {
+	it := &f5Iterator{f: f, perm: a.perms.get(f.Size())}
+	k := 0
+	for b := 0; b < f5StatusBits; b++ {
+		j := it.next()
+		if j < 0 {
+			return fmt.Errorf("Frame is too small to hold the F5 status")
+		}
+		k = k<<1 | f4Bit(f.GetElement(j))
+	}
+	if k < 1 || k > f5MaxK {
+		return fmt.Errorf("Frame has invalid F5 status %d", k)
+	}
+
+	group := make([]int, 1<<uint(k)-1)
+	for n := 0; n < len(p)*8; n += k {
+		for g := range group {
+			if group[g] = it.next(); group[g] < 0 {
+				return fmt.Errorf("Frame only holds %d of %d bits", n, len(p)*8)
+			}
+		}
+		h := it.hash(group)
+		for b := 0; b < k && n+b < len(p)*8; b++ {
+			setBit(p, n+b, h>>uint(k-1-b)&1)
+		}
+	}
+	return nil
+}
+
+// WriteBits implements Algorithm. The largest k which fits the data within the
+// frame is used, without shrinkage if no k fits otherwise. The frame is left
+// unmodified if it cannot hold p either way.
+func (a *f5) WriteBits(i int, f video.Frame, p []byte) error {
+	usable := f5Usable(f)
+	if usable < 0 {
+		return fmt.Errorf("Frame is too small to hold the F5 status")
+	}
+	for _, shrink := range []bool{true, false} {
+		for k := f5MaxK; k > 0; k-- {
+			if f5Groups(len(p)*8, k)*(1<<uint(k)-1) > usable {
+				continue
+			}
+			// Shrinkage uses up coefficients, a smaller k may still fit.
+			if changes := a.embed(f, p, k, shrink); changes != nil {
+				for j, val := range changes {
+					f.SetElement(j, val)
+				}
+				return nil
+			}
+		}
+	}
+	// Without shrinkage k = 1 embeds one bit in each usable coefficient.
+	return fmt.Errorf("Frame only holds %d of %d bits", usable, len(p)*8)
+}
+
+// f5Groups returns the number of groups of coefficients needed to embed bits
+// bits k at a time.
+func f5Groups(bits, k int) int {
+	return (bits + k - 1) / k
+}
+
+// embed embeds p within f using a (1, 2^k-1, k) code, flipping coefficients as
+// f4Flip does, and returns the modified coefficients without applying them to
+// f. Returns nil if f runs out of coefficients.
+func (a *f5) embed(f video.Frame, p []byte, k int, shrink bool) map[int]int {
+	it := &f5Iterator{f: f, perm: a.perms.get(f.Size()), changes: make(map[int]int)}
+
+	// The status is embedded using plain F4.
+	for b := 0; b < f5StatusBits; {
+		j := it.next()
+		if j < 0 {
+			return nil
+		}
+		if val := it.get(j); f4Bit(val) != k>>uint(f5StatusBits-1-b)&1 {
+			val = f4Flip(val, shrink)
+			it.changes[j] = val
+			if val == 0 {
+				// Shrinkage, the bit is embedded in the next coefficient.
+				continue
+			}
+		}
+		b++
+	}
+
+	group := make([]int, 0, 1<<uint(k)-1)
+	for n := 0; n < len(p)*8; n += k {
+		x := 0
+		for b := 0; b < k; b++ {
+			x <<= 1
+			if n+b < len(p)*8 {
+				x |= bit(p, n+b)
+			}
+		}
+		group = group[:0]
+		for {
+			for len(group) < cap(group) {
+				j := it.next()
+				if j < 0 {
+					return nil
+				}
+				group = append(group, j)
+			}
+			s := x ^ it.hash(group)
+			if s == 0 {
+				break
+			}
+			j := group[s-1]
+			val := f4Flip(it.get(j), shrink)
+			it.changes[j] = val
+			if val != 0 {
+				break
+			}
+			// Shrinkage, the group is refilled and embedded again.
+			group = append(group[:s-1], group[s:]...)
+		}
+	}
+	return it.changes
+}
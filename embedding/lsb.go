@@ -0,0 +1,49 @@
+package embedding
+
+import (
+	"stegasis/video"
+)
+
+func init() {
+	Register("lsb", newLSB)
+}
+
+// lsb embeds sequentially in the least significant bit of every frame
+// element. This is only suitable for frames of raw pixel data.
+type lsb struct {
+	cap int
+}
+
+func newLSB(opts Options) Algorithm {
+	return &lsb{
+		cap: opts.Cap,
+	}
+}
+
+// ElementType implements Algorithm.
+func (l *lsb) ElementType() video.ElementType {
+	return video.Pixels
+}
+
+// Capacity implements Algorithm.
+func (l *lsb) Capacity(i int, f video.Frame) int {
+	return f.Size() * l.cap / 100
+}
+
+// ReadBits implements Algorithm.
+func (l *lsb) ReadBits(i int, f video.Frame, p []byte) error {
+	for j := 0; j < len(p)*8; j++ {
+		setBit(p, j, f.GetElement(j)&1)
+	}
+	return nil
+}
+
+// WriteBits implements Algorithm.
+func (l *lsb) WriteBits(i int, f video.Frame, p []byte) error {
+	for j := 0; j < len(p)*8; j++ {
+		if val := f.GetElement(j); val&1 != bit(p, j) {
+			f.SetElement(j, val^1)
+		}
+	}
+	return nil
+}
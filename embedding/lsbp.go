@@ -0,0 +1,115 @@
+package embedding
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"stegasis/video"
+)
+
+func init() {
+	Register("lsbp", newLSBP)
+}
+
+// lsbp embeds in the least significant bit of frame elements visited in an
+// order given by an LCG seeded from the key. Like lsb this is only suitable
+// for frames of raw pixel data. Frames are visited in a key derived order.
+type lsbp struct {
+	key []byte
+	cap int
+}
+
+func newLSBP(opts Options) Algorithm {
+	return &lsbp{
+		key: opts.Key,
+		cap: opts.Cap,
+	}
+}
+
+// lcg generates a permutation of [0, n) using a full period linear congruential
+// generator modulo the next power of two, skipping values >= n.
+type lcg struct {
+	n, mask, a, c, x uint64
+}
+
+// newLCG returns an lcg over [0, n) whose parameters are derived from key.
+func newLCG(key []byte, n int) *lcg {
+	mask := uint64(1)
+	for mask < uint64(n) {
+		mask <<= 1
+	}
+	mask--
+
+	h := sha256.Sum256(key)
+	// The Hull-Dobell theorem gives a full period for a power of two modulus
+	// when c is odd and a-1 is a multiple of 4.
+	return &lcg{
+		n:    uint64(n),
+		mask: mask,
+		a:    binary.LittleEndian.Uint64(h[0:])&^3 | 1,
+		c:    binary.LittleEndian.Uint64(h[8:]) | 1,
+		x:    binary.LittleEndian.Uint64(h[16:]) & mask,
+	}
+}
+
+// next returns the next value of the permutation.
+func (l *lcg) next() int {
+	for {
+		l.x = (l.a*l.x + l.c) & l.mask
+		if l.x < l.n {
+			return int(l.x)
+		}
+	}
+}
+
+// FrameOrder implements FrameOrderer.
+func (l *lsbp) FrameOrder(n int) []int {
+	return framePermutation(l.key, n)
+}
+
+// ElementType implements Algorithm.
+func (l *lsbp) ElementType() video.ElementType {
+	return video.Pixels
+}
+
+// Capacity implements Algorithm.
+func (l *lsbp) Capacity(i int, f video.Frame) int {
+	return f.Size() * l.cap / 100
+}
+
+// checkSize returns an error if f has fewer elements than the bits of p, the
+// LCG would otherwise revisit elements, or never return one for an empty frame.
+func (l *lsbp) checkSize(f video.Frame, p []byte) error {
+	if len(p)*8 > f.Size() {
+		return fmt.Errorf("Frame only holds %d of %d bits", f.Size(), len(p)*8)
+	}
+	return nil
+}
+
+// ReadBits implements Algorithm.
+func (l *lsbp) ReadBits(i int, f video.Frame, p []byte) error {
+	if err := l.checkSize(f, p); err != nil {
+		return err
+	}
+	g := newLCG(l.key, f.Size())
+	for j := 0; j < len(p)*8; j++ {
+		setBit(p, j, f.GetElement(g.next())&1)
+	}
+	return nil
+}
+
+// WriteBits implements Algorithm.
+func (l *lsbp) WriteBits(i int, f video.Frame, p []byte) error {
+	if err := l.checkSize(f, p); err != nil {
+		return err
+	}
+	g := newLCG(l.key, f.Size())
+	for j := 0; j < len(p)*8; j++ {
+		e := g.next()
+		if val := f.GetElement(e); val&1 != bit(p, j) {
+			f.SetElement(e, val^1)
+		}
+	}
+	return nil
+}
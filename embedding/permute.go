@@ -0,0 +1,92 @@
+package embedding
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math/rand"
+	"sync"
+)
+
+// FrameOrderer is implemented by algorithms which visit the frames of a video
+// in an order other than the order they appear in.
+type FrameOrderer interface {
+	// FrameOrder returns the order in which the n frames of a video are
+	// visited.
+	FrameOrder(n int) []int
+}
+
+// FrameOrder returns the order in which alg visits the n frames of a video.
+// Unless alg permutes them the even frames are visited in order followed by the
+// odd frames, where a hidden volume may live.
+func FrameOrder(alg Algorithm, n int) []int {
+	if o, ok := alg.(FrameOrderer); ok {
+		return o.FrameOrder(n)
+	}
+	order := make([]int, 0, n)
+	for i := 0; i < n; i += 2 {
+		order = append(order, i)
+	}
+	for i := 1; i < n; i += 2 {
+		order = append(order, i)
+	}
+	return order
+}
+
+// framePermutation returns the order frames are visited in by keyed
+// algorithms. The first frame always comes first as it holds the volume header,
+// keeping its location independent of the key. The remaining even frames are
+// permuted using key and visited before the odd frames, which are permuted
+// separately. The start of a volume is so spread over the whole video while
+// the odd frames, where a hidden volume may live, are only used once the even
+// frames are full.
+func framePermutation(key []byte, n int) []int {
+	if n == 0 {
+		return nil
+	}
+	order := []int{0}
+	for _, i := range permutation(key, "frames", (n+1)/2-1) {
+		order = append(order, 2*i+2)
+	}
+	for _, i := range permutation(key, "hidden frames", n/2) {
+		order = append(order, 2*i+1)
+	}
+	return order
+}
+
+// permutation returns a permutation of [0, n) derived from key. Different
+// labels give independent permutations for the same key.
+func permutation(key []byte, label string, n int) []int {
+	h := sha256.New()
+	h.Write(key)
+	h.Write([]byte(label))
+	seed := int64(binary.LittleEndian.Uint64(h.Sum(nil)))
+	return rand.New(rand.NewSource(seed)).Perm(n)
+}
+
+// permutationCache caches the element permutation for each frame size, frames
+// of a video are almost always the same size so this is usually one entry.
+type permutationCache struct {
+	key   []byte
+	mux   sync.Mutex
+	perms map[int][]int
+}
+
+func newPermutationCache(key []byte) *permutationCache {
+	return &permutationCache{
+		key:   key,
+		perms: make(map[int][]int),
+	}
+}
+
+// get returns the permutation used to visit the elements of a frame of the
+// given size.
+func (c *permutationCache) get(size int) []int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	p, ok := c.perms[size]
+	if !ok {
+		p = permutation(c.key, "elements", size)
+		c.perms[size] = p
+	}
+	return p
+}
@@ -0,0 +1,135 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// errNoSpace is returned when no free blocks or inodes remain.
+	errNoSpace = errors.New("No space left on device")
+	// errFileTooLarge is returned for offsets beyond the largest file an inode
+	// can address.
+	errFileTooLarge = errors.New("File too large")
+)
+
+// readBlock reads block b into p, which must be blockSize bytes long.
+func (f *fs) readBlock(b uint32, p []byte) error {
+	return f.readAt(p, int64(b)*blockSize)
+}
+
+// writeBlock writes p, which must be blockSize bytes long, to block b.
+func (f *fs) writeBlock(b uint32, p []byte) error {
+	return f.writeAt(p, int64(b)*blockSize, false)
+}
+
+// loadBitmap reads the block bitmap into memory.
+func (f *fs) loadBitmap() error {
+	f.bitmap = make([]byte, f.sb.BitmapBlocks*blockSize)
+	if err := f.readAt(f.bitmap, int64(f.sb.BitmapStart)*blockSize); err != nil {
+		return fmt.Errorf("Failed to read block bitmap: %v", err)
+	}
+	f.freeBlocks = 0
+	f.protectedBlocks = 0
+	for b := f.sb.DataStart; b < f.sb.Blocks; b++ {
+		if !f.used(b) {
+			f.freeBlocks++
+			if f.isProtected(b) {
+				f.protectedBlocks++
+			}
+		}
+	}
+	f.nextBlock = f.sb.DataStart
+	return nil
+}
+
+// used returns true iff block b is allocated.
+func (f *fs) used(b uint32) bool {
+	return f.bitmap[b/8]&(1<<(b%8)) != 0
+}
+
+// setUsed marks block b as allocated or free in the in-memory bitmap.
+func (f *fs) setUsed(b uint32, used bool) {
+	if used {
+		f.bitmap[b/8] |= 1 << (b % 8)
+	} else {
+		f.bitmap[b/8] &^= 1 << (b % 8)
+	}
+}
+
+// isProtected returns true iff the device refuses writes to block b.
+func (f *fs) isProtected(b uint32) bool {
+	return f.protected != nil && f.protected.Protected(int64(b)*blockSize, blockSize)
+}
+
+// writeBitmap writes back the block of the bitmap holding the bit for block b.
+func (f *fs) writeBitmap(b uint32) error {
+	i := b / (blockSize * 8)
+	return f.writeAt(f.bitmap[i*blockSize:][:blockSize], int64(f.sb.BitmapStart+i)*blockSize, true)
+}
+
+// allocBlock allocates and zeroes a data block. Blocks are allocated lowest
+// first so a volume fills from its start, away from any hidden volume at its
+// end. Blocks the device refuses to write are never allocated, nor are blocks
+// freed since the last checkpoint as the journal may yet restore their owner.
+// Checkpointing here would commit a half finished operation, so those blocks
+// only become free once unlock checkpoints, see lowOnSpace.
+func (f *fs) allocBlock() (uint32, error) {
+	b, err := f.findFreeBlock()
+	if err != nil {
+		return 0, err
+	}
+	if err := f.writeBlock(b, make([]byte, blockSize)); err != nil {
+		return 0, err
+	}
+	f.setUsed(b, true)
+	if err := f.writeBitmap(b); err != nil {
+		return 0, err
+	}
+	f.freeBlocks--
+	f.nextBlock = b + 1
+	return b, nil
+}
+
+// findFreeBlock returns the lowest block allocBlock may allocate.
+func (f *fs) findFreeBlock() (uint32, error) {
+	for b := f.nextBlock; b < f.sb.Blocks; b++ {
+		if f.used(b) || f.freed[b] {
+			continue
+		}
+		if f.isProtected(b) {
+			continue
+		}
+		return b, nil
+	}
+	return 0, errNoSpace
+}
+
+// lowOnSpace returns true iff blocks freed since the last checkpoint, which
+// allocBlock skips, outnumber the free blocks allocBlock may still allocate.
+func (f *fs) lowOnSpace() bool {
+	n := int64(len(f.freed))
+	return n > 0 && f.freeBlocks-f.protectedBlocks-n < n
+}
+
+// freeBlock returns block b to the free pool.
+func (f *fs) freeBlock(b uint32) error {
+	if b < f.sb.DataStart || b >= f.sb.Blocks || !f.used(b) {
+		return fmt.Errorf("Freeing invalid block %d", b)
+	}
+	f.setUsed(b, false)
+	if err := f.writeBitmap(b); err != nil {
+		return err
+	}
+	f.freeBlocks++
+	if f.isProtected(b) {
+		f.protectedBlocks++
+	}
+	if f.freed != nil {
+		f.freed[b] = true
+	}
+	if b < f.nextBlock {
+		f.nextBlock = b
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package filesystem
+
+import (
+	"encoding/binary"
+)
+
+const (
+	// maxNameLen is the longest name a directory entry can hold.
+	maxNameLen = 251
+	// direntSize is the size of a directory entry, a directory's data is an
+	// array of entries.
+	direntSize = 4 + 1 + maxNameLen
+	// maxTargetLen is the longest target a symbolic link can hold.
+	maxTargetLen = 4095
+)
+
+// dirent is a directory entry linking name to an inode. Entries with a zero
+// inode are free.
+type dirent struct {
+	ino  uint32
+	name string
+}
+
+// decodeDirent decodes the direntSize bytes of an entry. The on-video layout
+// is the inode number, the name length and then the name.
+func decodeDirent(b []byte) dirent {
+	n := int(b[4])
+	if n > maxNameLen {
+		n = maxNameLen
+	}
+	return dirent{
+		ino:  binary.LittleEndian.Uint32(b),
+		name: string(b[5 : 5+n]),
+	}
+}
+
+// encode encodes the entry into direntSize bytes.
+func (d dirent) encode() []byte {
+	b := make([]byte, direntSize)
+	binary.LittleEndian.PutUint32(b, d.ino)
+	b[4] = byte(len(d.name))
+	copy(b[5:], d.name)
+	return b
+}
+
+// readDir returns the entries of the directory dir, including free entries so
+// the index of an entry gives its location.
+func (f *fs) readDir(dir *inode) ([]dirent, error) {
+	b := make([]byte, dir.Size)
+	if _, err := f.readData(dir, b, 0); err != nil {
+		return nil, err
+	}
+	entries := make([]dirent, len(b)/direntSize)
+	for i := range entries {
+		entries[i] = decodeDirent(b[i*direntSize:])
+	}
+	return entries, nil
+}
+
+// lookup returns the inode linked to name within the directory dir, zero if
+// there is none.
+func (f *fs) lookup(dir *inode, name string) (uint32, error) {
+	entries, err := f.readDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range entries {
+		if e.ino != 0 && e.name == name {
+			return e.ino, nil
+		}
+	}
+	return 0, nil
+}
+
+// addEntry links name to inode ino within the directory dir, reusing a free
+// entry if there is one. The caller must write back dir.
+func (f *fs) addEntry(dir *inode, name string, ino uint32) error {
+	if len(name) > maxNameLen {
+		return errNameTooLong
+	}
+	entries, err := f.readDir(dir)
+	if err != nil {
+		return err
+	}
+	i := len(entries)
+	for j, e := range entries {
+		if e.ino == 0 {
+			i = j
+			break
+		}
+	}
+	if _, err := f.writeData(dir, dirent{ino, name}.encode(), int64(i)*direntSize); err != nil {
+		return err
+	}
+	dir.modified()
+	return nil
+}
+
+// removeEntry removes the entry for name from the directory dir. The caller
+// must write back dir.
+func (f *fs) removeEntry(dir *inode, name string) error {
+	entries, err := f.readDir(dir)
+	if err != nil {
+		return err
+	}
+	for i, e := range entries {
+		if e.ino != 0 && e.name == name {
+			if _, err := f.writeData(dir, dirent{}.encode(), int64(i)*direntSize); err != nil {
+				return err
+			}
+			dir.modified()
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+// initDir writes the "." and ".." entries of the new directory dir, which is
+// inode ino within the directory parent. The caller must write back dir.
+func (f *fs) initDir(dir *inode, ino, parent uint32) error {
+	if err := f.addEntry(dir, ".", ino); err != nil {
+		return err
+	}
+	return f.addEntry(dir, "..", parent)
+}
+
+// isEmpty returns true iff the directory dir holds no entries other than "."
+// and "..".
+func (f *fs) isEmpty(dir *inode) (bool, error) {
+	entries, err := f.readDir(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if e.ino != 0 && e.name != "." && e.name != ".." {
+			return false, nil
+		}
+	}
+	return true, nil
+}
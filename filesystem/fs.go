@@ -2,68 +2,898 @@
 package filesystem
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
 	"stegasis/video"
 
 	"github.com/billziss-gh/cgofuse/fuse"
 )
 
+var (
+	errNotFound     = errors.New("No such file or directory")
+	errNotDir       = errors.New("Not a directory")
+	errIsDir        = errors.New("Is a directory")
+	errExists       = errors.New("File exists")
+	errNotEmpty     = errors.New("Directory not empty")
+	errNameTooLong  = errors.New("File name too long")
+	errInvalid      = errors.New("Invalid argument")
+	errPerm         = errors.New("Operation not permitted")
+	errTooManyLinks = errors.New("Too many links")
+)
+
+// FlushPolicy controls when modified frames are written back to the video.
+type FlushPolicy int
+
 const (
-	filename = "hello"
-	contents = "hello, world\n"
+	// WriteThrough writes modified frames back whenever a file is synced or
+	// closed.
+	WriteThrough FlushPolicy = iota
+	// Deferred keeps modified frames in memory until unmount, or until the
+	// metadata modified since they were last written back fills half of the
+	// journal.
+	Deferred
 )
 
-// fs implements the FUSE filesystem.
+// fs implements the FUSE filesystem. The filesystem is stored within dev, see
+// superblock for its layout.
 type fs struct {
 	fuse.FileSystemBase
-	codec video.Codec
+	codec  video.Codec
+	dev    Device
+	sb     superblock
+	policy FlushPolicy
+	// dirty is true iff frames have been modified since they were last
+	// written back.
+	dirty bool
+
+	// protected is dev if it refuses writes to some regions, nil otherwise.
+	protected protectedDevice
+	// bitmap is the in-memory copy of the block bitmap.
+	bitmap []byte
+	// freeBlocks is the number of unallocated data blocks.
+	freeBlocks int64
+	// nextBlock is the lowest block which may be free.
+	nextBlock uint32
+	// protectedBlocks is the number of free data blocks the device refuses to
+	// write.
+	protectedBlocks int64
+	// freeInodes is the number of unallocated inodes.
+	freeInodes int64
+	// pending holds the metadata blocks modified since the last checkpoint,
+	// nil while formatting as nothing needs journaling.
+	pending map[uint32][]byte
+	// freed holds the blocks freed since the last checkpoint.
+	freed map[uint32]bool
+	// journaled is true iff the journal holds a transaction already written
+	// to its home locations, which is cleared on unmount.
+	journaled bool
+
+	// mux serialises operations, FUSE calls operations concurrently. Use
+	// unlock to release it.
+	mux sync.Mutex
 }
 
-func (f *fs) Open(path string, flags int) (int, uint64) {
-	switch path {
-	case "/" + filename:
-		return 0, 0
-	default:
-		return -fuse.ENOENT, ^uint64(0)
+// unlock ends an operation which returns *errc. Once pending metadata fills
+// half of the journal it is checkpointed so the next operation fits within the
+// journal, as it is once the blocks freed since the last checkpoint are needed
+// for space. Checkpoints are only made here, between operations, so a
+// checkpoint never holds part of an operation. If the checkpoint fails the
+// operation fails with it, the metadata stays pending and the checkpoint is
+// retried by the next operation. The checkpoint writes the video back whatever
+// the flush policy, metadata written to its home locations would otherwise
+// reach the video unjournaled by the next write back.
+func (f *fs) unlock(errc *int) {
+	if len(f.pending) >= f.journalCapacity()/2 || f.lowOnSpace() {
+		if err := f.checkpoint(true); err != nil && *errc >= 0 {
+			*errc = errno(fmt.Errorf("Failed to checkpoint journal: %v", err))
+		}
 	}
-	return 0, 0
+	f.mux.Unlock()
 }
 
-func (f *fs) Getattr(path string, stat *fuse.Stat_t, fh uint64) int {
-	switch path {
-	case "/":
-		stat.Mode = fuse.S_IFDIR | 0555
-		return 0
-	case "/" + filename:
-		stat.Mode = fuse.S_IFREG | 0444
-		stat.Size = int64(len(contents))
+// errno returns the negated FUSE error code for err, zero for nil.
+func errno(err error) int {
+	switch err {
+	case nil:
 		return 0
-	default:
+	case errNotFound:
 		return -fuse.ENOENT
+	case errNotDir:
+		return -fuse.ENOTDIR
+	case errIsDir:
+		return -fuse.EISDIR
+	case errExists:
+		return -fuse.EEXIST
+	case errNotEmpty:
+		return -fuse.ENOTEMPTY
+	case errNameTooLong:
+		return -fuse.ENAMETOOLONG
+	case errInvalid:
+		return -fuse.EINVAL
+	case errPerm:
+		return -fuse.EPERM
+	case errTooManyLinks:
+		return -fuse.EMLINK
+	case errNoSpace:
+		return -fuse.ENOSPC
+	case errFileTooLarge:
+		return -fuse.EFBIG
+	case errNoXattr:
+		return -fuse.ENOATTR
+	case errXattrTooBig:
+		return -fuse.E2BIG
+	}
+	fmt.Printf("Filesystem error: %v\n", err)
+	return -fuse.EIO
+}
+
+// isDir returns true iff n is a directory.
+func (n *inode) isDir() bool {
+	return n.Mode&fuse.S_IFMT == fuse.S_IFDIR
+}
+
+// isSymlink returns true iff n is a symbolic link.
+func (n *inode) isSymlink() bool {
+	return n.Mode&fuse.S_IFMT == fuse.S_IFLNK
+}
+
+// isMeta returns true iff the contents of n are filesystem metadata, which is
+// the case for directories and the targets of symbolic links.
+func (n *inode) isMeta() bool {
+	return n.isDir() || n.isSymlink()
+}
+
+// resolve returns the inode at path. Every directory holds "." and ".."
+// entries so relative components are resolved like any other name.
+func (f *fs) resolve(path string) (uint32, *inode, error) {
+	ino := uint32(rootInode)
+	n, err := f.readInode(ino)
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		if !n.isDir() {
+			return 0, nil, errNotDir
+		}
+		if ino, err = f.lookup(n, name); err != nil {
+			return 0, nil, err
+		}
+		if ino == 0 {
+			return 0, nil, errNotFound
+		}
+		if n, err = f.readInode(ino); err != nil {
+			return 0, nil, err
+		}
+	}
+	return ino, n, nil
+}
+
+// resolveParent returns the directory holding path and the final name of path,
+// which must not be "." or "..".
+func (f *fs) resolveParent(path string) (uint32, *inode, string, error) {
+	path = strings.TrimRight(path, "/")
+	i := strings.LastIndex(path, "/")
+	name := path[i+1:]
+	if name == "" || name == "." || name == ".." {
+		return 0, nil, "", errInvalid
+	}
+	ino, dir, err := f.resolve(path[:i+1])
+	if err != nil {
+		return 0, nil, "", err
+	}
+	if !dir.isDir() {
+		return 0, nil, "", errNotDir
+	}
+	return ino, dir, name, nil
+}
+
+// contains returns true iff the directory dir is the directory ino or lies
+// beneath it.
+func (f *fs) contains(ino, dir uint32) (bool, error) {
+	for dir != ino {
+		if dir == rootInode {
+			return false, nil
+		}
+		n, err := f.readInode(dir)
+		if err != nil {
+			return false, err
+		}
+		if dir, err = f.lookup(n, ".."); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// create links a new inode with the given mode at path. The inode is owned by
+// the calling user.
+func (f *fs) create(path string, mode uint32) (uint32, error) {
+	pino, parent, name, err := f.resolveParent(path)
+	if err != nil {
+		return 0, err
+	}
+	if len(name) > maxNameLen {
+		return 0, errNameTooLong
+	}
+	if ino, err := f.lookup(parent, name); err != nil {
+		return 0, err
+	} else if ino != 0 {
+		return 0, errExists
+	}
+
+	uid, gid, _ := fuse.Getcontext()
+	n := &inode{
+		Mode:  mode,
+		Nlink: 1,
+		Uid:   uid,
+		Gid:   gid,
+	}
+	if n.isDir() {
+		n.Nlink = 2
+	}
+	n.modified()
+	n.Atime = n.Mtime
+	ino, err := f.allocInode(n)
+	if err != nil {
+		return 0, err
+	}
+	if n.isDir() {
+		if err := f.initDir(n, ino, pino); err != nil {
+			f.truncate(n, 0)
+			f.freeInode(ino)
+			return 0, err
+		}
+		if err := f.writeInode(ino, n); err != nil {
+			return 0, err
+		}
+	}
+	if err := f.addEntry(parent, name, ino); err != nil {
+		f.truncate(n, 0)
+		f.freeInode(ino)
+		return 0, err
+	}
+	if n.isDir() {
+		parent.Nlink++
+	}
+	return ino, f.writeInode(pino, parent)
+}
+
+// flush writes modified frames back to the video if the flush policy is
+// WriteThrough.
+func (f *fs) flush() error {
+	if f.policy != WriteThrough {
+		return nil
+	}
+	return f.sync()
+}
+
+// sync checkpoints pending metadata and writes all modified frames back to the
+// video.
+func (f *fs) sync() error {
+	if err := f.checkpoint(true); err != nil {
+		return err
+	}
+	if !f.dirty {
+		return nil
+	}
+	return f.encode()
+}
+
+// Destroy is called when the filesystem is unmounted and writes back any
+// modified frames regardless of the flush policy, along with the cleared
+// journal.
+func (f *fs) Destroy() {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	err := f.sync()
+	if err == nil && f.journaled {
+		if err = f.clearJournal(); err == nil {
+			err = f.encode()
+		}
+	}
+	if err != nil {
+		fmt.Printf("Failed to flush video on unmount: %v\n", err)
+	}
+}
+
+func (f *fs) Open(path string, flags int) (errc int, _ uint64) {
+	f.mux.Lock()
+	defer f.unlock(&errc)
+	ino, n, err := f.resolve(path)
+	if err != nil {
+		return errno(err), ^uint64(0)
+	}
+	if n.isDir() {
+		return -fuse.EISDIR, ^uint64(0)
+	}
+	if flags&fuse.O_TRUNC != 0 && flags&fuse.O_ACCMODE != fuse.O_RDONLY && n.Size != 0 {
+		if err := f.truncate(n, 0); err != nil {
+			return errno(err), ^uint64(0)
+		}
+		n.modified()
+		if err := f.writeInode(ino, n); err != nil {
+			return errno(err), ^uint64(0)
+		}
+	}
+	return 0, uint64(ino)
+}
+
+func (f *fs) Create(path string, flags int, mode uint32) (errc int, _ uint64) {
+	f.mux.Lock()
+	defer f.unlock(&errc)
+	ino, err := f.create(path, fuse.S_IFREG|mode&07777)
+	if err != nil {
+		return errno(err), ^uint64(0)
+	}
+	return 0, uint64(ino)
+}
+
+func (f *fs) Mkdir(path string, mode uint32) (errc int) {
+	f.mux.Lock()
+	defer f.unlock(&errc)
+	if _, err := f.create(path, fuse.S_IFDIR|mode&07777); err != nil {
+		return errno(err)
 	}
 	return 0
 }
 
-func (f *fs) Read(path string, buff []byte, ofst int64, fh uint64) int {
-	endofst := ofst + int64(len(buff))
-	if endofst > int64(len(contents)) {
-		endofst = int64(len(contents))
+func (f *fs) Unlink(path string) (errc int) {
+	f.mux.Lock()
+	defer f.unlock(&errc)
+	return errno(f.remove(path, false))
+}
+
+func (f *fs) Rmdir(path string) (errc int) {
+	f.mux.Lock()
+	defer f.unlock(&errc)
+	return errno(f.remove(path, true))
+}
+
+// remove removes the file or, if dir is true, the empty directory at path.
+func (f *fs) remove(path string, dir bool) error {
+	pino, parent, name, err := f.resolveParent(path)
+	if err != nil {
+		return err
 	}
-	if endofst < ofst {
-		return 0
+	ino, err := f.lookup(parent, name)
+	if err != nil {
+		return err
+	}
+	if ino == 0 {
+		return errNotFound
+	}
+	n, err := f.readInode(ino)
+	if err != nil {
+		return err
+	}
+	if dir && !n.isDir() {
+		return errNotDir
+	}
+	if !dir && n.isDir() {
+		return errIsDir
+	}
+	if dir {
+		if empty, err := f.isEmpty(n); err != nil {
+			return err
+		} else if !empty {
+			return errNotEmpty
+		}
+		parent.Nlink--
+	}
+	if err := f.removeEntry(parent, name); err != nil {
+		return err
+	}
+	if err := f.writeInode(pino, parent); err != nil {
+		return err
+	}
+	return f.unlink(ino, n)
+}
+
+func (f *fs) Link(oldpath string, newpath string) (errc int) {
+	f.mux.Lock()
+	defer f.unlock(&errc)
+	return errno(f.link(oldpath, newpath))
+}
+
+// link adds newpath as a further link to the inode at oldpath, which must not be
+// a directory.
+func (f *fs) link(oldpath, newpath string) error {
+	ino, n, err := f.resolve(oldpath)
+	if err != nil {
+		return err
+	}
+	if n.isDir() {
+		return errPerm
+	}
+	if n.Nlink == maxLinks {
+		return errTooManyLinks
+	}
+	pino, parent, name, err := f.resolveParent(newpath)
+	if err != nil {
+		return err
+	}
+	if existing, err := f.lookup(parent, name); err != nil {
+		return err
+	} else if existing != 0 {
+		return errExists
+	}
+	if err := f.addEntry(parent, name, ino); err != nil {
+		return err
+	}
+	if err := f.writeInode(pino, parent); err != nil {
+		return err
+	}
+	n.Nlink++
+	n.changed()
+	return f.writeInode(ino, n)
+}
+
+func (f *fs) Symlink(target string, newpath string) (errc int) {
+	f.mux.Lock()
+	defer f.unlock(&errc)
+	return errno(f.symlink(target, newpath))
+}
+
+// symlink creates a symbolic link to target at newpath. The target is stored
+// as the contents of the link.
+func (f *fs) symlink(target, newpath string) error {
+	if target == "" {
+		return errNotFound
+	}
+	if len(target) > maxTargetLen {
+		return errNameTooLong
+	}
+	ino, err := f.create(newpath, fuse.S_IFLNK|0777)
+	if err != nil {
+		return err
+	}
+	n, err := f.readInode(ino)
+	if err != nil {
+		return err
+	}
+	if _, err := f.writeData(n, []byte(target), 0); err != nil {
+		f.writeInode(ino, n)
+		f.remove(newpath, false)
+		return err
+	}
+	return f.writeInode(ino, n)
+}
+
+func (f *fs) Readlink(path string) (errc int, _ string) {
+	f.mux.Lock()
+	defer f.unlock(&errc)
+	_, n, err := f.resolve(path)
+	if err != nil {
+		return errno(err), ""
+	}
+	if !n.isSymlink() {
+		return -fuse.EINVAL, ""
+	}
+	b := make([]byte, n.Size)
+	if _, err := f.readData(n, b, 0); err != nil {
+		return errno(err), ""
+	}
+	return 0, string(b)
+}
+
+func (f *fs) Rename(oldpath string, newpath string) (errc int) {
+	f.mux.Lock()
+	defer f.unlock(&errc)
+	return errno(f.rename(oldpath, newpath))
+}
+
+// rename moves the inode at oldpath to newpath, replacing anything already at
+// newpath.
+func (f *fs) rename(oldpath, newpath string) error {
+	opino, oparent, oname, err := f.resolveParent(oldpath)
+	if err != nil {
+		return err
+	}
+	ino, err := f.lookup(oparent, oname)
+	if err != nil {
+		return err
+	}
+	if ino == 0 {
+		return errNotFound
+	}
+	n, err := f.readInode(ino)
+	if err != nil {
+		return err
+	}
+	npino, nparent, nname, err := f.resolveParent(newpath)
+	if err != nil {
+		return err
+	}
+	if len(nname) > maxNameLen {
+		return errNameTooLong
+	}
+	if n.isDir() && npino != opino {
+		// A directory cannot be moved beneath itself.
+		if within, err := f.contains(ino, npino); err != nil {
+			return err
+		} else if within {
+			return errInvalid
+		}
+	}
+
+	target, err := f.lookup(nparent, nname)
+	if err != nil {
+		return err
+	}
+	if target == ino {
+		return nil
+	}
+	if target != 0 {
+		t, err := f.readInode(target)
+		if err != nil {
+			return err
+		}
+		if t.isDir() {
+			if !n.isDir() {
+				return errIsDir
+			}
+			if empty, err := f.isEmpty(t); err != nil {
+				return err
+			} else if !empty {
+				return errNotEmpty
+			}
+			nparent.Nlink--
+		} else if n.isDir() {
+			return errNotDir
+		}
+		if err := f.removeEntry(nparent, nname); err != nil {
+			return err
+		}
+		if err := f.unlink(target, t); err != nil {
+			return err
+		}
+	}
+
+	if err := f.addEntry(nparent, nname, ino); err != nil {
+		return err
+	}
+	if n.isDir() {
+		nparent.Nlink++
+	}
+	if err := f.writeInode(npino, nparent); err != nil {
+		return err
+	}
+	// Reread the old parent as it may be the new parent.
+	if oparent, err = f.readInode(opino); err != nil {
+		return err
+	}
+	if err := f.removeEntry(oparent, oname); err != nil {
+		return err
+	}
+	if n.isDir() {
+		oparent.Nlink--
+	}
+	if err := f.writeInode(opino, oparent); err != nil {
+		return err
+	}
+	if n.isDir() && npino != opino {
+		if err := f.removeEntry(n, ".."); err != nil {
+			return err
+		}
+		if err := f.addEntry(n, "..", npino); err != nil {
+			return err
+		}
+	}
+	n.changed()
+	return f.writeInode(ino, n)
+}
+
+func (f *fs) Chmod(path string, mode uint32) (errc int) {
+	f.mux.Lock()
+	defer f.unlock(&errc)
+	ino, n, err := f.resolve(path)
+	if err != nil {
+		return errno(err)
+	}
+	n.Mode = n.Mode&fuse.S_IFMT | mode&07777
+	n.changed()
+	return errno(f.writeInode(ino, n))
+}
+
+func (f *fs) Chown(path string, uid uint32, gid uint32) (errc int) {
+	f.mux.Lock()
+	defer f.unlock(&errc)
+	ino, n, err := f.resolve(path)
+	if err != nil {
+		return errno(err)
+	}
+	// An ID of -1 leaves the owner unchanged.
+	if uid != ^uint32(0) {
+		n.Uid = uid
+	}
+	if gid != ^uint32(0) {
+		n.Gid = gid
+	}
+	n.changed()
+	return errno(f.writeInode(ino, n))
+}
+
+func (f *fs) Utimens(path string, tmsp []fuse.Timespec) (errc int) {
+	f.mux.Lock()
+	defer f.unlock(&errc)
+	ino, n, err := f.resolve(path)
+	if err != nil {
+		return errno(err)
+	}
+	n.changed()
+	if tmsp == nil {
+		n.Atime = n.Ctime
+		n.Mtime = n.Ctime
+	} else {
+		n.Atime = tmsp[0].Time().UnixNano()
+		n.Mtime = tmsp[1].Time().UnixNano()
+	}
+	return errno(f.writeInode(ino, n))
+}
+
+// Setxattr sets an extended attribute. All the attributes of an inode, with
+// their names, share one block, see xattr, and Setxattr fails with E2BIG once
+// they no longer fit.
+func (f *fs) Setxattr(path string, name string, value []byte, flags int) (errc int) {
+	f.mux.Lock()
+	defer f.unlock(&errc)
+	ino, n, err := f.resolve(path)
+	if err != nil {
+		return errno(err)
+	}
+	if err := f.setXattr(n, name, value, flags&fuse.XATTR_CREATE != 0, flags&fuse.XATTR_REPLACE != 0); err != nil {
+		return errno(err)
+	}
+	n.changed()
+	return errno(f.writeInode(ino, n))
+}
+
+func (f *fs) Getxattr(path string, name string) (errc int, _ []byte) {
+	f.mux.Lock()
+	defer f.unlock(&errc)
+	_, n, err := f.resolve(path)
+	if err != nil {
+		return errno(err), nil
+	}
+	attrs, err := f.readXattrs(n)
+	if err != nil {
+		return errno(err), nil
+	}
+	for _, a := range attrs {
+		if a.name == name {
+			return 0, a.value
+		}
+	}
+	return -fuse.ENOATTR, nil
+}
+
+func (f *fs) Removexattr(path string, name string) (errc int) {
+	f.mux.Lock()
+	defer f.unlock(&errc)
+	ino, n, err := f.resolve(path)
+	if err != nil {
+		return errno(err)
+	}
+	if err := f.removeXattr(n, name); err != nil {
+		return errno(err)
+	}
+	n.changed()
+	return errno(f.writeInode(ino, n))
+}
+
+func (f *fs) Listxattr(path string, fill func(name string) bool) (errc int) {
+	f.mux.Lock()
+	defer f.unlock(&errc)
+	_, n, err := f.resolve(path)
+	if err != nil {
+		return errno(err)
+	}
+	attrs, err := f.readXattrs(n)
+	if err != nil {
+		return errno(err)
 	}
-	return copy(buff, contents[ofst:endofst])
+	for _, a := range attrs {
+		if !fill(a.name) {
+			return -fuse.ERANGE
+		}
+	}
+	return 0
 }
 
-func (f *fs) Readdir(path string, fill func(name string, stat *fuse.Stat_t, ofst int64) bool, ofst int64, fh uint64) int {
-	fill(".", nil, 0)
-	fill("..", nil, 0)
-	fill(filename, nil, 0)
+func (f *fs) Getattr(path string, stat *fuse.Stat_t, fh uint64) (errc int) {
+	f.mux.Lock()
+	defer f.unlock(&errc)
+	ino, n, err := f.resolve(path)
+	if err != nil {
+		return errno(err)
+	}
+	stat.Ino = uint64(ino)
+	stat.Mode = n.Mode
+	stat.Nlink = n.Nlink
+	stat.Uid = n.Uid
+	stat.Gid = n.Gid
+	stat.Size = int64(n.Size)
+	stat.Atim = fuse.NewTimespec(time.Unix(0, n.Atime))
+	stat.Mtim = fuse.NewTimespec(time.Unix(0, n.Mtime))
+	stat.Ctim = fuse.NewTimespec(time.Unix(0, n.Ctime))
+	stat.Blksize = blockSize
+	stat.Blocks = (int64(n.Size) + 511) / 512
 	return 0
 }
 
-// New returns a new fs object which implements fuse.FileSystemInterface.
-func New(codec video.Codec) *fs {
-	return &fs{
-		codec: codec,
+// Statfs reports the capacity of the filesystem, which is the capacity of the
+// frames at the embedding capacity the volume was formatted with.
+func (f *fs) Statfs(path string, stat *fuse.Statfs_t) (errc int) {
+	f.mux.Lock()
+	defer f.unlock(&errc)
+	stat.Bsize = blockSize
+	stat.Frsize = blockSize
+	stat.Blocks = uint64(f.sb.Blocks - f.sb.DataStart)
+	stat.Bfree = uint64(f.freeBlocks)
+	stat.Bavail = uint64(f.freeBlocks - f.protectedBlocks)
+	stat.Files = uint64(f.sb.Inodes - 1)
+	stat.Ffree = uint64(f.freeInodes)
+	stat.Favail = uint64(f.freeInodes)
+	stat.Namemax = maxNameLen
+	return 0
+}
+
+func (f *fs) Read(path string, buff []byte, ofst int64, fh uint64) (errc int) {
+	f.mux.Lock()
+	defer f.unlock(&errc)
+	_, n, err := f.resolve(path)
+	if err != nil {
+		return errno(err)
+	}
+	if n.isDir() {
+		return -fuse.EISDIR
+	}
+	read, err := f.readData(n, buff, ofst)
+	if err != nil {
+		return errno(err)
+	}
+	return read
+}
+
+func (f *fs) Write(path string, buff []byte, ofst int64, fh uint64) (errc int) {
+	f.mux.Lock()
+	defer f.unlock(&errc)
+	ino, n, err := f.resolve(path)
+	if err != nil {
+		return errno(err)
+	}
+	if n.isDir() {
+		return -fuse.EISDIR
+	}
+	written, err := f.writeData(n, buff, ofst)
+	if written > 0 {
+		n.modified()
+	}
+	if err := f.writeInode(ino, n); err != nil {
+		return errno(err)
+	}
+	if written == 0 && err != nil {
+		return errno(err)
+	}
+	return written
+}
+
+func (f *fs) Truncate(path string, size int64, fh uint64) (errc int) {
+	f.mux.Lock()
+	defer f.unlock(&errc)
+	ino, n, err := f.resolve(path)
+	if err != nil {
+		return errno(err)
+	}
+	if n.isDir() {
+		return -fuse.EISDIR
+	}
+	if err := f.truncate(n, size); err != nil {
+		f.writeInode(ino, n)
+		return errno(err)
+	}
+	n.modified()
+	return errno(f.writeInode(ino, n))
+}
+
+// Flush is called on each close of a file. Writes are stored within the frames
+// as they are made, frames are written to the video by Fsync and Release.
+func (f *fs) Flush(path string, fh uint64) int {
+	return 0
+}
+
+// Fsync writes modified frames back to the video, unless flushing is deferred
+// until unmount.
+func (f *fs) Fsync(path string, datasync bool, fh uint64) (errc int) {
+	f.mux.Lock()
+	defer f.unlock(&errc)
+	return errno(f.flush())
+}
+
+// Fsyncdir is Fsync for directories.
+func (f *fs) Fsyncdir(path string, datasync bool, fh uint64) int {
+	return f.Fsync(path, datasync, fh)
+}
+
+// Release is called once the last reference to an open file is closed, see
+// Fsync.
+func (f *fs) Release(path string, fh uint64) int {
+	return f.Fsync(path, false, fh)
+}
+
+func (f *fs) Readdir(path string, fill func(name string, stat *fuse.Stat_t, ofst int64) bool, ofst int64, fh uint64) (errc int) {
+	f.mux.Lock()
+	defer f.unlock(&errc)
+	_, n, err := f.resolve(path)
+	if err != nil {
+		return errno(err)
+	}
+	if !n.isDir() {
+		return -fuse.ENOTDIR
+	}
+	entries, err := f.readDir(n)
+	if err != nil {
+		return errno(err)
+	}
+	for _, e := range entries {
+		if e.ino != 0 && !fill(e.name, nil, 0) {
+			break
+		}
+	}
+	return 0
+}
+
+// New returns a new fs object which implements fuse.FileSystemInterface. The
+// filesystem is read from dev, which must have been formatted with Format, and
+// codec is encoded as given by policy and when the filesystem is unmounted.
+func New(codec video.Codec, dev Device, policy FlushPolicy) (*fs, error) {
+	b := make([]byte, binary.Size(superblock{}))
+	if _, err := dev.ReadAt(b, 0); err != nil {
+		return nil, fmt.Errorf("Failed to read superblock: %v", err)
+	}
+	f := &fs{
+		codec:  codec,
+		dev:    dev,
+		policy: policy,
+	}
+	f.protected, _ = dev.(protectedDevice)
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &f.sb); err != nil {
+		return nil, fmt.Errorf("Failed to read superblock: %v", err)
+	}
+	if f.sb.Magic != superblockMagic {
+		return nil, fmt.Errorf("No filesystem found")
+	}
+	if f.sb.Version != superblockVersion {
+		return nil, fmt.Errorf("Unsupported filesystem version %d", f.sb.Version)
+	}
+	if f.sb.BlockSize != blockSize || int64(f.sb.Blocks)*blockSize > dev.Size() {
+		return nil, fmt.Errorf("Filesystem does not match the volume")
+	}
+	if err := f.replay(); err != nil {
+		return nil, err
+	}
+	if err := f.loadBitmap(); err != nil {
+		return nil, err
+	}
+	err := f.scanInodes(func(ino uint32, free bool) bool {
+		if free {
+			f.freeInodes++
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read inode table: %v", err)
 	}
+	f.pending = make(map[uint32][]byte)
+	f.freed = make(map[uint32]bool)
+	return f, nil
 }
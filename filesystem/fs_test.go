@@ -0,0 +1,528 @@
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"stegasis/video"
+	"stegasis/video/videotest"
+	"stegasis/volume"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+)
+
+// testDeviceSize is the size of the device filesystems are tested on.
+const testDeviceSize = 4 << 20
+
+// memDevice is an in memory Device. It starts out filled with random data, as
+// a formatted volume is.
+type memDevice struct {
+	data []byte
+	// failBelow makes every write before this offset fail.
+	failBelow int64
+}
+
+func newMemDevice() *memDevice {
+	d := &memDevice{data: make([]byte, testDeviceSize)}
+	rand.New(rand.NewSource(1)).Read(d.data)
+	return d
+}
+
+func (d *memDevice) ReadAt(p []byte, off int64) (int, error) {
+	return copy(p, d.data[off:]), nil
+}
+
+func (d *memDevice) WriteAt(p []byte, off int64) (int, error) {
+	if off < d.failBelow {
+		return 0, errors.New("Write failed")
+	}
+	return copy(d.data[off:], p), nil
+}
+
+func (d *memDevice) Size() int64 {
+	return int64(len(d.data))
+}
+
+// memCodec is the video holding a memDevice, it has no frames of its own.
+// Encode records the contents of the device so a mount killed at any point can
+// be simulated.
+type memCodec struct {
+	*videotest.Codec
+	dev       *memDevice
+	snapshots [][]byte
+	// torn holds, for each Encode after the first, the video as left by that
+	// Encode killed after writing back every other block it modified, as a
+	// codec which does not encode atomically may be.
+	torn [][]byte
+}
+
+func newMemCodec(dev *memDevice) *memCodec {
+	return &memCodec{Codec: videotest.NewCodec(0, video.Pixels), dev: dev}
+}
+
+func (c *memCodec) Encode() error {
+	if n := len(c.snapshots); n > 0 {
+		torn := append([]byte{}, c.snapshots[n-1]...)
+		modified := 0
+		for off := 0; off < len(torn); off += blockSize {
+			b := c.dev.data[off : off+blockSize]
+			if !bytes.Equal(torn[off:off+blockSize], b) {
+				if modified%2 == 0 {
+					copy(torn[off:], b)
+				}
+				modified++
+			}
+		}
+		c.torn = append(c.torn, torn)
+	}
+	c.snapshots = append(c.snapshots, append([]byte{}, c.dev.data...))
+	return nil
+}
+
+// restore returns a device holding the video as written by the nth Encode.
+func (c *memCodec) restore(n int) *memCodec {
+	return newMemCodec(&memDevice{data: append([]byte{}, c.snapshots[n]...)})
+}
+
+// newTestFS formats a filesystem on a new memDevice.
+func newTestFS(t *testing.T) *memCodec {
+	c := newMemCodec(newMemDevice())
+	if err := Format(c.dev); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// mount opens the filesystem held by c.
+func mount(t *testing.T, c *memCodec, policy FlushPolicy) *fs {
+	f, err := New(c, c.dev, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// remount unmounts f and mounts the filesystem again.
+func remount(t *testing.T, f *fs, c *memCodec) *fs {
+	f.Destroy()
+	return mount(t, c, f.policy)
+}
+
+func stat(t *testing.T, f *fs, path string) *fuse.Stat_t {
+	var st fuse.Stat_t
+	if e := f.Getattr(path, &st, 0); e != 0 {
+		t.Fatalf("Getattr %q: %d", path, e)
+	}
+	return &st
+}
+
+func names(t *testing.T, f *fs, path string) []string {
+	var names []string
+	e := f.Readdir(path, func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		names = append(names, name)
+		return true
+	}, 0, 0)
+	if e != 0 {
+		t.Fatalf("Readdir %q: %d", path, e)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func readFile(t *testing.T, f *fs, path string) []byte {
+	b := make([]byte, stat(t, f, path).Size)
+	if n := f.Read(path, b, 0, 0); n != len(b) {
+		t.Fatalf("Read %q: %d", path, n)
+	}
+	return b
+}
+
+func check(t *testing.T, op string, e int) {
+	if e < 0 {
+		t.Fatalf("%s: %d", op, e)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	f := mount(t, newTestFS(t), WriteThrough)
+	st := stat(t, f, "/")
+	if st.Mode&fuse.S_IFMT != fuse.S_IFDIR || st.Nlink != 2 {
+		t.Fatalf("Root has mode %o and %d links", st.Mode, st.Nlink)
+	}
+	if got := names(t, f, "/"); len(got) != 2 || got[0] != "." || got[1] != ".." {
+		t.Fatalf("Root holds %v", got)
+	}
+	if e := f.Getattr("/none", &fuse.Stat_t{}, 0); e != -fuse.ENOENT {
+		t.Fatalf("Getattr of a missing file: %d", e)
+	}
+	if _, err := New(newMemCodec(nil), newMemDevice(), WriteThrough); err == nil {
+		t.Fatal("New of an unformatted device did not fail")
+	}
+}
+
+func TestFiles(t *testing.T) {
+	c := newTestFS(t)
+	f := mount(t, c, WriteThrough)
+	check(t, "Create", func() int { e, _ := f.Create("/a", 0, 0644); return e }())
+	// Directories never shrink, so free space is counted once the root holds
+	// the entry for the file.
+	var before fuse.Statfs_t
+	f.Statfs("/", &before)
+
+	r := rand.New(rand.NewSource(2))
+	want := make([]byte, 300000)
+	r.Read(want)
+	if n := f.Write("/a", want, 0, 0); n != len(want) {
+		t.Fatalf("Write: %d", n)
+	}
+	patch := []byte("unaligned")
+	if n := f.Write("/a", patch, 12345, 0); n != len(patch) {
+		t.Fatalf("Write: %d", n)
+	}
+	copy(want[12345:], patch)
+	check(t, "Release", f.Release("/a", 0))
+
+	f = remount(t, f, c)
+	if got := readFile(t, f, "/a"); !bytes.Equal(got, want) {
+		t.Fatal("File does not hold the data written")
+	}
+	check(t, "Truncate", f.Truncate("/a", 1000, 0))
+	f = remount(t, f, c)
+	if got := readFile(t, f, "/a"); !bytes.Equal(got, want[:1000]) {
+		t.Fatal("Truncated file does not hold the start of the data written")
+	}
+
+	check(t, "Unlink", f.Unlink("/a"))
+	f = remount(t, f, c)
+	if e := f.Getattr("/a", &fuse.Stat_t{}, 0); e != -fuse.ENOENT {
+		t.Fatalf("Getattr of an unlinked file: %d", e)
+	}
+	var after fuse.Statfs_t
+	f.Statfs("/", &after)
+	if after.Bfree != before.Bfree || after.Ffree != before.Ffree+1 {
+		t.Fatalf("Unlink left %d free blocks and %d free inodes, want %d and %d", after.Bfree, after.Ffree, before.Bfree, before.Ffree+1)
+	}
+}
+
+func TestRenameDir(t *testing.T) {
+	c := newTestFS(t)
+	f := mount(t, c, WriteThrough)
+	check(t, "Mkdir", f.Mkdir("/a", 0755))
+	check(t, "Mkdir", f.Mkdir("/a/b", 0755))
+	check(t, "Mkdir", f.Mkdir("/c", 0755))
+	check(t, "Create", func() int { e, _ := f.Create("/a/b/f", 0, 0644); return e }())
+	f.Write("/a/b/f", []byte("moved"), 0, 0)
+
+	if e := f.Rename("/a", "/a/b/a"); e != -fuse.EINVAL {
+		t.Fatalf("Rename of a directory into itself: %d", e)
+	}
+	check(t, "Rename", f.Rename("/a/b", "/c/b"))
+	f = remount(t, f, c)
+
+	if e := f.Getattr("/a/b", &fuse.Stat_t{}, 0); e != -fuse.ENOENT {
+		t.Fatalf("Getattr of the old name: %d", e)
+	}
+	if got := readFile(t, f, "/c/b/f"); string(got) != "moved" {
+		t.Fatalf("Renamed directory holds %q", got)
+	}
+	if n := stat(t, f, "/a").Nlink; n != 2 {
+		t.Fatalf("Old parent has %d links, want 2", n)
+	}
+	if n := stat(t, f, "/c").Nlink; n != 3 {
+		t.Fatalf("New parent has %d links, want 3", n)
+	}
+	if stat(t, f, "/c/b/..").Ino != stat(t, f, "/c").Ino {
+		t.Fatal("Renamed directory has the wrong parent")
+	}
+	if e := f.Rmdir("/c"); e != -fuse.ENOTEMPTY {
+		t.Fatalf("Rmdir of a directory which is not empty: %d", e)
+	}
+}
+
+func TestLinks(t *testing.T) {
+	c := newTestFS(t)
+	f := mount(t, c, WriteThrough)
+	check(t, "Mkdir", f.Mkdir("/d", 0755))
+	check(t, "Create", func() int { e, _ := f.Create("/d/a", 0, 0644); return e }())
+	f.Write("/d/a", []byte("data"), 0, 0)
+	check(t, "Link", f.Link("/d/a", "/b"))
+	if e := f.Link("/d", "/e"); e != -fuse.EPERM {
+		t.Fatalf("Link of a directory: %d", e)
+	}
+	check(t, "Symlink", f.Symlink("d/a", "/s"))
+	f = remount(t, f, c)
+
+	if n := stat(t, f, "/b").Nlink; n != 2 {
+		t.Fatalf("Linked file has %d links, want 2", n)
+	}
+	if e, target := f.Readlink("/s"); e != 0 || target != "d/a" {
+		t.Fatalf("Readlink: %d %q", e, target)
+	}
+	if st := stat(t, f, "/s"); st.Mode&fuse.S_IFMT != fuse.S_IFLNK || st.Size != 3 {
+		t.Fatalf("Symlink has mode %o and size %d", st.Mode, st.Size)
+	}
+	if e, _ := f.Readlink("/b"); e != -fuse.EINVAL {
+		t.Fatalf("Readlink of a file: %d", e)
+	}
+
+	check(t, "Unlink", f.Unlink("/d/a"))
+	f = remount(t, f, c)
+	if got := readFile(t, f, "/b"); string(got) != "data" {
+		t.Fatalf("Link holds %q", got)
+	}
+	if n := stat(t, f, "/b").Nlink; n != 1 {
+		t.Fatalf("File has %d links, want 1", n)
+	}
+}
+
+func TestXattr(t *testing.T) {
+	c := newTestFS(t)
+	f := mount(t, c, WriteThrough)
+	check(t, "Create", func() int { e, _ := f.Create("/a", 0, 0644); return e }())
+	check(t, "Setxattr", f.Setxattr("/a", "user.origin", []byte("scanner"), 0))
+	check(t, "Setxattr", f.Setxattr("/a", "user.class", []byte("secret"), 0))
+	if e := f.Setxattr("/a", "user.class", []byte("x"), fuse.XATTR_CREATE); e != -fuse.EEXIST {
+		t.Fatalf("Setxattr XATTR_CREATE of an existing attribute: %d", e)
+	}
+	if e := f.Setxattr("/a", "user.none", []byte("x"), fuse.XATTR_REPLACE); e != -fuse.ENOATTR {
+		t.Fatalf("Setxattr XATTR_REPLACE of a missing attribute: %d", e)
+	}
+	check(t, "Setxattr", f.Setxattr("/a", "user.class", []byte("top"), fuse.XATTR_REPLACE))
+	if e := f.Setxattr("/a", "user.big", make([]byte, blockSize+1), 0); e != -fuse.E2BIG {
+		t.Fatalf("Setxattr of an attribute larger than a block: %d", e)
+	}
+	if e := f.Setxattr("/a", "user.big", make([]byte, blockSize-30), 0); e != -fuse.E2BIG {
+		t.Fatalf("Setxattr of an attribute overflowing the block: %d", e)
+	}
+	f = remount(t, f, c)
+
+	if e, v := f.Getxattr("/a", "user.class"); e != 0 || string(v) != "top" {
+		t.Fatalf("Getxattr: %d %q", e, v)
+	}
+	var list []string
+	f.Listxattr("/a", func(name string) bool {
+		list = append(list, name)
+		return true
+	})
+	sort.Strings(list)
+	if len(list) != 2 || list[0] != "user.class" || list[1] != "user.origin" {
+		t.Fatalf("Listxattr: %v", list)
+	}
+	check(t, "Removexattr", f.Removexattr("/a", "user.class"))
+	if e := f.Removexattr("/a", "user.class"); e != -fuse.ENOATTR {
+		t.Fatalf("Removexattr of a missing attribute: %d", e)
+	}
+	f = remount(t, f, c)
+	if e, _ := f.Getxattr("/a", "user.class"); e != -fuse.ENOATTR {
+		t.Fatalf("Getxattr of a removed attribute: %d", e)
+	}
+}
+
+// TestJournalReplay kills a mount between writing the journal and writing the
+// metadata to its home locations, the journal must be replayed on the next
+// mount. A journal which was only partly written must be ignored.
+func TestJournalReplay(t *testing.T) {
+	c := newTestFS(t)
+	f := mount(t, c, WriteThrough)
+	check(t, "Mkdir", f.Mkdir("/d", 0755))
+	check(t, "Create", func() int { e, _ := f.Create("/d/a", 0, 0644); return e }())
+	f.Write("/d/a", []byte("journaled"), 0, 0)
+	c.snapshots = nil
+	check(t, "Release", f.Release("/d/a", 0))
+	if len(c.snapshots) != 2 {
+		t.Fatalf("Checkpoint wrote the video back %d times, want 2", len(c.snapshots))
+	}
+
+	killed := c.restore(0)
+	g := mount(t, killed, WriteThrough)
+	if got := readFile(t, g, "/d/a"); string(got) != "journaled" {
+		t.Fatalf("Replayed file holds %q", got)
+	}
+	g = remount(t, g, killed)
+	if got := readFile(t, g, "/d/a"); string(got) != "journaled" {
+		t.Fatalf("Replayed file holds %q after remount", got)
+	}
+
+	torn := c.restore(0)
+	off := int64(f.sb.JournalStart+2) * blockSize
+	torn.dev.data[off] ^= 0xff
+	g = mount(t, torn, WriteThrough)
+	if e := g.Getattr("/d", &fuse.Stat_t{}, 0); e != -fuse.ENOENT {
+		t.Fatalf("Getattr of a directory only in a torn journal: %d", e)
+	}
+	check(t, "Mkdir", g.Mkdir("/d", 0755))
+}
+
+// TestCheckpointError checks operations fail while their checkpoint cannot be
+// written, and succeed once it can. Only metadata writes fail, so the failure
+// is in the checkpoint rather than the operation itself.
+func TestCheckpointError(t *testing.T) {
+	c := newTestFS(t)
+	f := mount(t, c, Deferred)
+	c.dev.failBelow = int64(f.sb.DataStart) * blockSize
+	failed := -1
+	for i := 0; i < f.journalCapacity() && failed < 0; i++ {
+		if e := f.Mkdir("/"+string(rune('a'+i%26))+string(rune('a'+i/26)), 0755); e == -fuse.EIO {
+			failed = i
+		} else {
+			check(t, "Mkdir", e)
+		}
+	}
+	if failed < 0 {
+		t.Fatal("No operation failed while the device could not be written")
+	}
+	c.dev.failBelow = 0
+	check(t, "Mkdir", f.Mkdir("/last", 0755))
+	f = remount(t, f, c)
+	if got := names(t, f, "/"); len(got) != failed+4 {
+		t.Fatalf("Root holds %d entries, want %d", len(got), failed+4)
+	}
+}
+
+// TestReuseFreedBlocks checks blocks freed before a checkpoint can be
+// allocated once the checkpoint is written, so the whole volume can be filled.
+func TestReuseFreedBlocks(t *testing.T) {
+	c := newTestFS(t)
+	f := mount(t, c, WriteThrough)
+	check(t, "Create", func() int { e, _ := f.Create("/a", 0, 0644); return e }())
+	f.Write("/a", make([]byte, 100000), 0, 0)
+	check(t, "Release", f.Release("/a", 0))
+	check(t, "Unlink", f.Unlink("/a"))
+	check(t, "Create", func() int { e, _ := f.Create("/b", 0, 0644); return e }())
+	f.Write("/b", []byte("small"), 0, 0)
+	check(t, "Release", f.Release("/b", 0))
+
+	check(t, "Create", func() int { e, _ := f.Create("/c", 0, 0644); return e }())
+	buf := make([]byte, 64<<10)
+	for off := int64(0); ; off += int64(len(buf)) {
+		if n := f.Write("/c", buf, off, 0); n != len(buf) {
+			break
+		}
+	}
+	var st fuse.Statfs_t
+	f.Statfs("/", &st)
+	if st.Bfree != 0 {
+		t.Fatalf("Volume is full with %d blocks free", st.Bfree)
+	}
+}
+
+// TestNoSpaceCrash frees blocks while the volume is full and then creates a
+// directory, which needs blocks. The video must never be written back part way
+// through an operation, so every write back holds a directory entry for each
+// allocated inode.
+func TestNoSpaceCrash(t *testing.T) {
+	c := newTestFS(t)
+	f := mount(t, c, WriteThrough)
+	check(t, "Create", func() int { e, _ := f.Create("/a", 0, 0644); return e }())
+	f.Write("/a", make([]byte, 10000), 0, 0)
+	check(t, "Create", func() int { e, _ := f.Create("/c", 0, 0644); return e }())
+	buf := make([]byte, 64<<10)
+	for off := int64(0); ; off += int64(len(buf)) {
+		if n := f.Write("/c", buf, off, 0); n != len(buf) {
+			break
+		}
+	}
+	check(t, "Release", f.Release("/c", 0))
+
+	// Every inode other than the root is linked from the root.
+	var st fuse.Statfs_t
+	f.Statfs("/", &st)
+	inodes := st.Ffree + uint64(len(names(t, f, "/"))-2)
+
+	c.snapshots = nil
+	check(t, "Unlink", f.Unlink("/a"))
+	if e := f.Mkdir("/d", 0755); e != 0 && e != -fuse.ENOSPC {
+		t.Fatalf("Mkdir: %d", e)
+	}
+	check(t, "Fsync", f.Fsync("/", false, 0))
+	for n := range c.snapshots {
+		g := mount(t, c.restore(n), WriteThrough)
+		g.Statfs("/", &st)
+		if got := st.Ffree + uint64(len(names(t, g, "/"))-2); got != inodes {
+			t.Fatalf("Write back %d holds %d free and linked inodes, want %d", n, got, inodes)
+		}
+	}
+}
+
+// TestDeferredTornEncode makes enough directories while flushing is deferred
+// for their metadata to outgrow the journal, killing every write back of the
+// video part way through. Every killed write back must hold a directory entry
+// for each allocated inode.
+func TestDeferredTornEncode(t *testing.T) {
+	c := newTestFS(t)
+	f := mount(t, c, Deferred)
+	var st fuse.Statfs_t
+	f.Statfs("/", &st)
+	inodes := st.Ffree
+	c.snapshots = [][]byte{append([]byte{}, c.dev.data...)}
+	for i := 0; i < f.journalCapacity()*2 && uint64(i) < inodes; i++ {
+		check(t, "Mkdir", f.Mkdir(fmt.Sprintf("/%d", i), 0755))
+	}
+	f.Destroy()
+	if len(c.torn) < 2 {
+		t.Fatalf("Video was only written back %d times", len(c.torn))
+	}
+	for n, data := range c.torn {
+		g := mount(t, newMemCodec(&memDevice{data: data}), Deferred)
+		g.Statfs("/", &st)
+		if got := st.Ffree + uint64(len(names(t, g, "/"))-2); got != inodes {
+			t.Fatalf("Killed write back %d holds %d free and linked inodes, want %d", n, got, inodes)
+		}
+	}
+}
+
+// TestEmbeddedWear runs a filesystem on volumes embedded with the algorithms
+// whose frames lose capacity as they are rewritten, at the default --cap. Every
+// checkpoint rewrites the frames holding the superblock, bitmap and journal, so
+// they are rewritten far more often than the rest of the volume.
+func TestEmbeddedWear(t *testing.T) {
+	for _, alg := range []string{"f4", "f5"} {
+		t.Run(alg, func(t *testing.T) {
+			c := videotest.NewCodec(1, video.DCTCoefficients, videotest.Sizes(32, 32768)...)
+			opts := volume.Options{Alg: alg, Pass: "pass", Cap: 100}
+			v, err := volume.Format(c, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := Format(v); err != nil {
+				t.Fatal(err)
+			}
+
+			r := rand.New(rand.NewSource(3))
+			want := make(map[string][]byte)
+			for i := 0; i < 40; i++ {
+				if v, err = volume.Open(c, opts); err != nil {
+					t.Fatal(err)
+				}
+				f, err := New(c, v, WriteThrough)
+				if err != nil {
+					t.Fatalf("Mount %d: %v", i, err)
+				}
+				for name, data := range want {
+					if got := readFile(t, f, name); !bytes.Equal(got, data) {
+						t.Fatalf("Mount %d: %s does not hold the data written", i, name)
+					}
+				}
+				// There are only a few inodes, files are replaced once
+				// each has been created.
+				name := fmt.Sprintf("/%d", i%8)
+				if _, ok := want[name]; ok {
+					check(t, "Unlink", f.Unlink(name))
+				}
+				data := make([]byte, 500)
+				r.Read(data)
+				check(t, "Create", func() int { e, _ := f.Create(name, 0, 0644); return e }())
+				if n := f.Write(name, data, 0, 0); n != len(data) {
+					t.Fatalf("Write %d: %d", i, n)
+				}
+				check(t, "Release", f.Release(name, 0))
+				want[name] = data
+				f.Destroy()
+			}
+		})
+	}
+}
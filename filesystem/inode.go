@@ -0,0 +1,383 @@
+package filesystem
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	// inodeSize is the size of an inode within the inode table.
+	inodeSize      = 128
+	inodesPerBlock = blockSize / inodeSize
+	// rootInode is the inode of the root directory, inode 0 is never used so
+	// it can mark free directory entries and block pointers.
+	rootInode = 1
+	// maxLinks is the most links an inode can have.
+	maxLinks = 1<<32 - 1
+
+	// directBlocks is the number of block pointers held directly within an
+	// inode. They are followed by a single, double and triple indirect block.
+	directBlocks = 12
+	// ptrsPerBlock is the number of block pointers held by an indirect block.
+	ptrsPerBlock = blockSize / 4
+)
+
+// inode is the on-video layout of the metadata of a file or directory. An
+// inode with a zero Mode is free.
+type inode struct {
+	Mode  uint32
+	Nlink uint32
+	Uid   uint32
+	Gid   uint32
+	Size  uint64
+	// Times are nanoseconds since the Unix epoch.
+	Atime int64
+	Mtime int64
+	Ctime int64
+	// Blocks holds the direct block pointers followed by the single, double
+	// and triple indirect block pointers. Zero pointers are holes.
+	Blocks [directBlocks + 3]uint32
+	// Xattr is the block holding the extended attributes, zero if there are
+	// none.
+	Xattr uint32
+	_     [16]byte
+}
+
+// inodeOffset returns the device offset of inode ino.
+func (f *fs) inodeOffset(ino uint32) (int64, error) {
+	if ino == 0 || ino >= f.sb.Inodes {
+		return 0, fmt.Errorf("Invalid inode %d", ino)
+	}
+	return int64(f.sb.InodeStart)*blockSize + int64(ino)*inodeSize, nil
+}
+
+// readInode reads inode ino from the inode table.
+func (f *fs) readInode(ino uint32) (*inode, error) {
+	off, err := f.inodeOffset(ino)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, inodeSize)
+	if err := f.readAt(b, off); err != nil {
+		return nil, err
+	}
+	n := &inode{}
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// writeInode writes n to inode ino of the inode table.
+func (f *fs) writeInode(ino uint32, n *inode) error {
+	off, err := f.inodeOffset(ino)
+	if err != nil {
+		return err
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, inodeSize))
+	if err := binary.Write(buf, binary.LittleEndian, n); err != nil {
+		return err
+	}
+	return f.writeAt(buf.Bytes(), off, true)
+}
+
+// readPtrs reads the block pointers held by indirect block b.
+func (f *fs) readPtrs(b uint32) ([]uint32, error) {
+	p := make([]byte, blockSize)
+	if err := f.readBlock(b, p); err != nil {
+		return nil, err
+	}
+	ptrs := make([]uint32, ptrsPerBlock)
+	for i := range ptrs {
+		ptrs[i] = binary.LittleEndian.Uint32(p[i*4:])
+	}
+	return ptrs, nil
+}
+
+// writePtr sets the ith block pointer held by indirect block b.
+func (f *fs) writePtr(b uint32, i int64, ptr uint32) error {
+	p := make([]byte, 4)
+	binary.LittleEndian.PutUint32(p, ptr)
+	return f.writeAt(p, int64(b)*blockSize+i*4, true)
+}
+
+// bmap returns the block holding block i of the file n, zero for a hole. If
+// alloc is true holes are filled with newly allocated blocks, in which case the
+// caller must write back n.
+func (f *fs) bmap(n *inode, i int64, alloc bool) (uint32, error) {
+	if i < directBlocks {
+		return f.mapPtr(&n.Blocks[i], alloc)
+	}
+	i -= directBlocks
+	span := int64(ptrsPerBlock)
+	for level := 1; level <= 3; level++ {
+		if i < span {
+			b, err := f.mapPtr(&n.Blocks[directBlocks+level-1], alloc)
+			if err != nil || b == 0 {
+				return 0, err
+			}
+			return f.mapIndirect(b, span/ptrsPerBlock, i, alloc)
+		}
+		i -= span
+		span *= ptrsPerBlock
+	}
+	return 0, errFileTooLarge
+}
+
+// mapPtr returns the block *ptr points to, allocating it if alloc is true and
+// *ptr is zero.
+func (f *fs) mapPtr(ptr *uint32, alloc bool) (uint32, error) {
+	if *ptr == 0 && alloc {
+		b, err := f.allocBlock()
+		if err != nil {
+			return 0, err
+		}
+		*ptr = b
+	}
+	return *ptr, nil
+}
+
+// mapIndirect returns the block holding block i of the tree rooted at indirect
+// block b, where each pointer of b covers span blocks.
+func (f *fs) mapIndirect(b uint32, span, i int64, alloc bool) (uint32, error) {
+	ptrs, err := f.readPtrs(b)
+	if err != nil {
+		return 0, err
+	}
+	j := i / span
+	next := ptrs[j]
+	if next == 0 {
+		if !alloc {
+			return 0, nil
+		}
+		if next, err = f.allocBlock(); err != nil {
+			return 0, err
+		}
+		if err := f.writePtr(b, j, next); err != nil {
+			return 0, err
+		}
+	}
+	if span == 1 {
+		return next, nil
+	}
+	return f.mapIndirect(next, span/ptrsPerBlock, i%span, alloc)
+}
+
+// readData reads from the file n into p starting at off. Returns the number of
+// bytes read, which is less than len(p) at the end of the file.
+func (f *fs) readData(n *inode, p []byte, off int64) (int, error) {
+	if off >= int64(n.Size) {
+		return 0, nil
+	}
+	if rem := int64(n.Size) - off; int64(len(p)) > rem {
+		p = p[:rem]
+	}
+	for done := 0; done < len(p); {
+		pos := off + int64(done)
+		b, err := f.bmap(n, pos/blockSize, false)
+		if err != nil {
+			return done, err
+		}
+		chunk := p[done:]
+		if max := blockSize - int(pos%blockSize); len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		if b == 0 {
+			for i := range chunk {
+				chunk[i] = 0
+			}
+		} else if err := f.readAt(chunk, int64(b)*blockSize+pos%blockSize); err != nil {
+			return done, err
+		}
+		done += len(chunk)
+	}
+	return len(p), nil
+}
+
+// writeData writes p to the file n at off, allocating blocks as needed and
+// extending the file. The contents of directories and symbolic links are
+// journaled. Returns the number of bytes written. The caller must write back n,
+// even if an error is returned.
+func (f *fs) writeData(n *inode, p []byte, off int64) (int, error) {
+	for done := 0; done < len(p); {
+		pos := off + int64(done)
+		b, err := f.bmap(n, pos/blockSize, true)
+		if err != nil {
+			return done, err
+		}
+		chunk := p[done:]
+		if max := blockSize - int(pos%blockSize); len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		if err := f.writeAt(chunk, int64(b)*blockSize+pos%blockSize, n.isMeta()); err != nil {
+			return done, err
+		}
+		done += len(chunk)
+		if end := uint64(pos) + uint64(len(chunk)); end > n.Size {
+			n.Size = end
+		}
+	}
+	return len(p), nil
+}
+
+// truncate sets the size of the file n, freeing any blocks beyond its new end.
+// The caller must write back n.
+func (f *fs) truncate(n *inode, size int64) error {
+	if size < int64(n.Size) && size%blockSize != 0 {
+		// Zero the rest of the last block so extending the file reads zeros.
+		b, err := f.bmap(n, size/blockSize, false)
+		if err != nil {
+			return err
+		}
+		if b != 0 {
+			if err := f.writeAt(make([]byte, blockSize-size%blockSize), int64(b)*blockSize+size%blockSize, n.isMeta()); err != nil {
+				return err
+			}
+		}
+	}
+
+	keep := (size + blockSize - 1) / blockSize
+	for i := keep; i < directBlocks; i++ {
+		if n.Blocks[i] != 0 {
+			if err := f.freeBlock(n.Blocks[i]); err != nil {
+				return err
+			}
+			n.Blocks[i] = 0
+		}
+	}
+	start, span := int64(directBlocks), int64(ptrsPerBlock)
+	for level := 1; level <= 3; level++ {
+		if ptr := &n.Blocks[directBlocks+level-1]; *ptr != 0 {
+			empty, err := f.freeIndirect(*ptr, span/ptrsPerBlock, keep-start)
+			if err != nil {
+				return err
+			}
+			if empty {
+				if err := f.freeBlock(*ptr); err != nil {
+					return err
+				}
+				*ptr = 0
+			}
+		}
+		start += span
+		span *= ptrsPerBlock
+	}
+	n.Size = uint64(size)
+	return nil
+}
+
+// freeIndirect frees the blocks from block keep onwards of the tree rooted at
+// indirect block b, where each pointer of b covers span blocks. Returns true
+// iff the tree no longer holds any blocks, in which case b itself is left for
+// the caller to free.
+func (f *fs) freeIndirect(b uint32, span, keep int64) (bool, error) {
+	ptrs, err := f.readPtrs(b)
+	if err != nil {
+		return false, err
+	}
+	empty := true
+	for j, ptr := range ptrs {
+		if ptr == 0 {
+			continue
+		}
+		first := int64(j) * span
+		if first+span <= keep {
+			empty = false
+			continue
+		}
+		if span > 1 {
+			sub, err := f.freeIndirect(ptr, span/ptrsPerBlock, keep-first)
+			if err != nil {
+				return false, err
+			}
+			if !sub {
+				empty = false
+				continue
+			}
+		}
+		if err := f.freeBlock(ptr); err != nil {
+			return false, err
+		}
+		if keep > 0 {
+			if err := f.writePtr(b, int64(j), 0); err != nil {
+				return false, err
+			}
+		}
+	}
+	return empty, nil
+}
+
+// allocInode stores n in a free inode of the inode table and returns its
+// number.
+func (f *fs) allocInode(n *inode) (uint32, error) {
+	var ino uint32
+	err := f.scanInodes(func(i uint32, free bool) bool {
+		if free {
+			ino = i
+		}
+		return !free
+	})
+	if err != nil {
+		return 0, err
+	}
+	if ino == 0 {
+		return 0, errNoSpace
+	}
+	f.freeInodes--
+	return ino, f.writeInode(ino, n)
+}
+
+// freeInode returns inode ino to the free pool.
+func (f *fs) freeInode(ino uint32) error {
+	f.freeInodes++
+	return f.writeInode(ino, &inode{})
+}
+
+// scanInodes calls fn with each inode of the inode table in turn, along with
+// whether it is free, until fn returns false.
+func (f *fs) scanInodes(fn func(ino uint32, free bool) bool) error {
+	b := make([]byte, blockSize)
+	for blk := uint32(0); blk < f.sb.Inodes/inodesPerBlock; blk++ {
+		if err := f.readBlock(f.sb.InodeStart+blk, b); err != nil {
+			return err
+		}
+		for i := uint32(0); i < inodesPerBlock; i++ {
+			ino := blk*inodesPerBlock + i
+			if ino != 0 && !fn(ino, binary.LittleEndian.Uint32(b[i*inodeSize:]) == 0) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// unlink drops a link to inode ino, freeing the inode, its blocks and its
+// extended attributes once no links remain.
+func (f *fs) unlink(ino uint32, n *inode) error {
+	n.Nlink--
+	if n.isDir() || n.Nlink == 0 {
+		if err := f.truncate(n, 0); err != nil {
+			return err
+		}
+		if err := f.freeXattrs(n); err != nil {
+			return err
+		}
+		return f.freeInode(ino)
+	}
+	n.changed()
+	return f.writeInode(ino, n)
+}
+
+// modified updates the modification and change times of n.
+func (n *inode) modified() {
+	now := time.Now().UnixNano()
+	n.Mtime = now
+	n.Ctime = now
+}
+
+// changed updates the change time of n.
+func (n *inode) changed() {
+	n.Ctime = time.Now().UnixNano()
+}
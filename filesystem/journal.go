@@ -0,0 +1,266 @@
+package filesystem
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"stegasis/video"
+)
+
+// Metadata (the block bitmap, inodes, indirect blocks and directory contents)
+// is never written to its home location directly. Modified metadata blocks
+// are held in memory until a checkpoint, which first writes them to the
+// journal and writes the video back, then writes them to their home locations
+// and writes the video back again. A journal found on mount is replayed if it
+// is complete and ignored otherwise, so a killed mount always leaves the
+// metadata of either the last or the previous checkpoint. The journal is not
+// cleared in the write back holding the home locations, as a write back killed
+// part way through could then hold the cleared journal without them. It stays
+// in the video, replaying it again is harmless, until the next transaction
+// replaces it or it is cleared on unmount. Codecs which encode
+// atomically already give this guarantee, so for them the journal is skipped
+// and the metadata written to its home locations before a single write back.
+//
+// File data is written directly and so reaches the video no later than the
+// metadata which refers to it.
+
+// journalMagic marks a complete journal transaction.
+var journalMagic = [8]byte{'S', 'T', 'E', 'G', 'J', 'R', 'N', 'L'}
+
+// journalHeader is stored in the first block of the journal, it is followed by
+// blocks holding the home location of each journaled block and then the
+// journaled blocks themselves.
+type journalHeader struct {
+	Magic [8]byte
+	Count uint32
+	// Checksum is the SHA-256 of the locations and blocks of the transaction.
+	Checksum [sha256.Size]byte
+}
+
+// journalCapacity returns the most blocks a single transaction can hold.
+func (f *fs) journalCapacity() int {
+	n := int(f.sb.JournalBlocks) - 1
+	for n > 0 && 1+(n+ptrsPerBlock-1)/ptrsPerBlock+n > int(f.sb.JournalBlocks) {
+		n--
+	}
+	return n
+}
+
+// readAt reads len(p) bytes at off, seeing metadata not yet checkpointed.
+func (f *fs) readAt(p []byte, off int64) error {
+	if len(f.pending) == 0 {
+		_, err := f.dev.ReadAt(p, off)
+		return err
+	}
+	for done := 0; done < len(p); {
+		pos := off + int64(done)
+		chunk := p[done:]
+		if max := blockSize - int(pos%blockSize); len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		if b, ok := f.pending[uint32(pos/blockSize)]; ok {
+			copy(chunk, b[pos%blockSize:])
+		} else if _, err := f.dev.ReadAt(chunk, pos); err != nil {
+			return err
+		}
+		done += len(chunk)
+	}
+	return nil
+}
+
+// writeAt writes p at off. Metadata, and any block still pending from when it
+// held metadata, is held until the next checkpoint. All writes go through
+// writeAt so the frames are known to need writing back.
+func (f *fs) writeAt(p []byte, off int64, meta bool) error {
+	f.dirty = true
+	if f.pending == nil {
+		_, err := f.dev.WriteAt(p, off)
+		return err
+	}
+	for done := 0; done < len(p); {
+		pos := off + int64(done)
+		chunk := p[done:]
+		if max := blockSize - int(pos%blockSize); len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		bn := uint32(pos / blockSize)
+		b, ok := f.pending[bn]
+		if !ok && meta {
+			b = make([]byte, blockSize)
+			if _, err := f.dev.ReadAt(b, int64(bn)*blockSize); err != nil {
+				return err
+			}
+			f.pending[bn] = b
+			ok = true
+		}
+		if ok {
+			copy(b[pos%blockSize:], chunk)
+		} else if _, err := f.dev.WriteAt(chunk, pos); err != nil {
+			return err
+		}
+		done += len(chunk)
+	}
+	return nil
+}
+
+// encode writes all modified frames back to the video.
+func (f *fs) encode() error {
+	if err := f.codec.Encode(); err != nil {
+		return fmt.Errorf("Failed to flush video: %v", err)
+	}
+	f.dirty = false
+	return nil
+}
+
+// checkpoint writes pending metadata to its home locations. If barrier is
+// false the journal is skipped and the video is not written back, which is
+// only safe if the video is then written back atomically. Transactions larger
+// than the journal are split and so are not atomic, unless the codec encodes
+// atomically.
+func (f *fs) checkpoint(barrier bool) error {
+	if barrier && video.IsAtomic(f.codec) {
+		pending := len(f.pending) > 0
+		if err := f.checkpoint(false); err != nil || !pending {
+			return err
+		}
+		return f.encode()
+	}
+
+	blocks := make([]uint32, 0, len(f.pending))
+	for b := range f.pending {
+		blocks = append(blocks, b)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+
+	for len(blocks) > 0 {
+		txn := blocks
+		if max := f.journalCapacity(); len(txn) > max {
+			txn = txn[:max]
+		}
+		blocks = blocks[len(txn):]
+
+		if barrier {
+			if err := f.writeJournal(txn); err != nil {
+				return fmt.Errorf("Failed to write journal: %v", err)
+			}
+			if err := f.encode(); err != nil {
+				return err
+			}
+		}
+		for _, b := range txn {
+			if _, err := f.dev.WriteAt(f.pending[b], int64(b)*blockSize); err != nil {
+				return fmt.Errorf("Failed to checkpoint journal: %v", err)
+			}
+			delete(f.pending, b)
+		}
+		if barrier {
+			if err := f.encode(); err != nil {
+				return err
+			}
+			f.journaled = true
+		}
+	}
+	// Blocks freed since the last checkpoint were skipped by allocBlock, which
+	// may have moved nextBlock past them.
+	for b := range f.freed {
+		if b < f.nextBlock {
+			f.nextBlock = b
+		}
+	}
+	f.freed = make(map[uint32]bool)
+	return nil
+}
+
+// writeJournal writes the pending blocks to the journal as one transaction.
+func (f *fs) writeJournal(blocks []uint32) error {
+	locs := make([]byte, (len(blocks)+ptrsPerBlock-1)/ptrsPerBlock*blockSize)
+	for i, b := range blocks {
+		binary.LittleEndian.PutUint32(locs[i*4:], b)
+	}
+	h := sha256.New()
+	h.Write(locs)
+	next := int64(f.sb.JournalStart+1) * blockSize
+	if _, err := f.dev.WriteAt(locs, next); err != nil {
+		return err
+	}
+	next += int64(len(locs))
+	for _, b := range blocks {
+		h.Write(f.pending[b])
+		if _, err := f.dev.WriteAt(f.pending[b], next); err != nil {
+			return err
+		}
+		next += blockSize
+	}
+
+	jh := journalHeader{
+		Magic: journalMagic,
+		Count: uint32(len(blocks)),
+	}
+	copy(jh.Checksum[:], h.Sum(nil))
+	return f.writeJournalHeader(&jh)
+}
+
+// clearJournal marks the journal as holding no transaction.
+func (f *fs) clearJournal() error {
+	return f.writeJournalHeader(&journalHeader{})
+}
+
+func (f *fs) writeJournalHeader(jh *journalHeader) error {
+	buf := bytes.NewBuffer(make([]byte, 0, blockSize))
+	if err := binary.Write(buf, binary.LittleEndian, jh); err != nil {
+		return err
+	}
+	b := make([]byte, blockSize)
+	copy(b, buf.Bytes())
+	_, err := f.dev.WriteAt(b, int64(f.sb.JournalStart)*blockSize)
+	return err
+}
+
+// replay completes a transaction left in the journal by a checkpoint which did
+// not finish. Incomplete transactions are discarded.
+func (f *fs) replay() error {
+	b := make([]byte, blockSize)
+	if _, err := f.dev.ReadAt(b, int64(f.sb.JournalStart)*blockSize); err != nil {
+		return fmt.Errorf("Failed to read journal: %v", err)
+	}
+	var jh journalHeader
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &jh); err != nil {
+		return fmt.Errorf("Failed to read journal: %v", err)
+	}
+	if jh.Magic != journalMagic || jh.Count == 0 || int(jh.Count) > f.journalCapacity() {
+		return nil
+	}
+
+	locs := make([]byte, (int(jh.Count)+ptrsPerBlock-1)/ptrsPerBlock*blockSize)
+	blocks := make([]byte, int(jh.Count)*blockSize)
+	next := int64(f.sb.JournalStart+1) * blockSize
+	if _, err := f.dev.ReadAt(locs, next); err != nil {
+		return fmt.Errorf("Failed to read journal: %v", err)
+	}
+	if _, err := f.dev.ReadAt(blocks, next+int64(len(locs))); err != nil {
+		return fmt.Errorf("Failed to read journal: %v", err)
+	}
+	h := sha256.New()
+	h.Write(locs)
+	h.Write(blocks)
+	if !bytes.Equal(h.Sum(nil), jh.Checksum[:]) {
+		return f.clearJournal()
+	}
+
+	fmt.Printf("Replaying journal of %d blocks.\n", jh.Count)
+	for i := 0; i < int(jh.Count); i++ {
+		home := binary.LittleEndian.Uint32(locs[i*4:])
+		if home == 0 || home >= f.sb.Blocks || home >= f.sb.JournalStart && home < f.sb.DataStart {
+			return fmt.Errorf("Journal holds invalid block %d", home)
+		}
+		if _, err := f.dev.WriteAt(blocks[i*blockSize:][:blockSize], int64(home)*blockSize); err != nil {
+			return fmt.Errorf("Failed to replay journal: %v", err)
+		}
+	}
+	f.dirty = true
+	f.journaled = true
+	return nil
+}
@@ -0,0 +1,165 @@
+package filesystem
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+)
+
+const (
+	superblockVersion = 3
+
+	// blockSize is the size of a filesystem block. It is a whole number of
+	// encryption sectors so writing a block never rewrites its neighbours.
+	blockSize = 512
+	// inodeRatio is the number of blocks per inode, which fixes the number of
+	// files a filesystem can hold at format time.
+	inodeRatio = 8
+	// minInodes is the fewest inodes a filesystem is formatted with.
+	minInodes = 16
+	// journalRatio is the number of blocks per journal block, within the
+	// bounds of minJournalBlocks and maxJournalBlocks.
+	journalRatio     = 32
+	minJournalBlocks = 8
+	maxJournalBlocks = 1024
+)
+
+var superblockMagic = [8]byte{'S', 'T', 'E', 'G', 'F', 'S', 0, 0}
+
+// Device defines the storage a filesystem lives on.
+type Device interface {
+	io.ReaderAt
+	io.WriterAt
+	// Size returns the size of the device in bytes.
+	Size() int64
+}
+
+// protectedDevice is implemented by devices which refuse writes to some of
+// their regions, such as an outer volume protecting a hidden volume.
+type protectedDevice interface {
+	// Protected returns true iff writing n bytes at off would be refused.
+	Protected(off, n int64) bool
+}
+
+// superblock is stored in the first block of the device and describes the
+// filesystem. The device is laid out as:
+//
+//	superblock | block bitmap | inode table | journal | data blocks
+//
+// All locations are block numbers.
+type superblock struct {
+	Magic         [8]byte
+	Version       uint32
+	BlockSize     uint32
+	Blocks        uint32
+	BitmapStart   uint32
+	BitmapBlocks  uint32
+	InodeStart    uint32
+	Inodes        uint32
+	JournalStart  uint32
+	JournalBlocks uint32
+	DataStart     uint32
+}
+
+// newSuperblock returns the layout of a filesystem on a device of size bytes.
+func newSuperblock(size int64) (superblock, error) {
+	blocks := size / blockSize
+	if blocks > 1<<32-1 {
+		blocks = 1<<32 - 1
+	}
+	inodes := blocks / inodeRatio
+	if inodes < minInodes {
+		inodes = minInodes
+	}
+	inodeBlocks := (inodes + inodesPerBlock - 1) / inodesPerBlock
+	bitmapBlocks := (blocks + blockSize*8 - 1) / (blockSize * 8)
+	journalBlocks := blocks / journalRatio
+	if journalBlocks < minJournalBlocks {
+		journalBlocks = minJournalBlocks
+	}
+	if journalBlocks > maxJournalBlocks {
+		journalBlocks = maxJournalBlocks
+	}
+
+	sb := superblock{
+		Magic:         superblockMagic,
+		Version:       superblockVersion,
+		BlockSize:     blockSize,
+		Blocks:        uint32(blocks),
+		BitmapStart:   1,
+		BitmapBlocks:  uint32(bitmapBlocks),
+		InodeStart:    uint32(1 + bitmapBlocks),
+		Inodes:        uint32(inodeBlocks * inodesPerBlock),
+		JournalStart:  uint32(1 + bitmapBlocks + inodeBlocks),
+		JournalBlocks: uint32(journalBlocks),
+		DataStart:     uint32(1 + bitmapBlocks + inodeBlocks + journalBlocks),
+	}
+	if int64(sb.DataStart) >= blocks {
+		return sb, fmt.Errorf("Volume of %d bytes is too small for a filesystem", size)
+	}
+	return sb, nil
+}
+
+// Format writes an empty filesystem to dev, holding only the root directory.
+func Format(dev Device) error {
+	sb, err := newSuperblock(dev.Size())
+	if err != nil {
+		return err
+	}
+	f := &fs{
+		dev:       dev,
+		sb:        sb,
+		bitmap:    make([]byte, sb.BitmapBlocks*blockSize),
+		nextBlock: sb.DataStart,
+	}
+	f.protected, _ = dev.(protectedDevice)
+
+	// The device may hold random data so every metadata block is written
+	// explicitly, as is the journal header.
+	zero := make([]byte, blockSize)
+	for b := sb.InodeStart; b <= sb.JournalStart; b++ {
+		if err := f.writeBlock(b, zero); err != nil {
+			return fmt.Errorf("Failed to write inode table: %v", err)
+		}
+	}
+	for b := uint32(0); b < sb.DataStart; b++ {
+		f.setUsed(b, true)
+	}
+	for b := sb.BitmapStart; b < sb.InodeStart; b++ {
+		if err := f.writeBlock(b, f.bitmap[(b-sb.BitmapStart)*blockSize:][:blockSize]); err != nil {
+			return fmt.Errorf("Failed to write block bitmap: %v", err)
+		}
+	}
+
+	now := time.Now().UnixNano()
+	root := &inode{
+		Mode:  fuse.S_IFDIR | 0755,
+		Nlink: 2,
+		Uid:   uint32(os.Getuid()),
+		Gid:   uint32(os.Getgid()),
+		Atime: now,
+		Mtime: now,
+		Ctime: now,
+	}
+	// The parent of the root directory is itself.
+	if err := f.initDir(root, rootInode, rootInode); err != nil {
+		return fmt.Errorf("Failed to write root directory: %v", err)
+	}
+	if err := f.writeInode(rootInode, root); err != nil {
+		return fmt.Errorf("Failed to write root directory: %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := binary.Write(buf, binary.LittleEndian, &sb); err != nil {
+		return err
+	}
+	if _, err := dev.WriteAt(buf.Bytes(), 0); err != nil {
+		return fmt.Errorf("Failed to write superblock: %v", err)
+	}
+	return nil
+}
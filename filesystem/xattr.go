@@ -0,0 +1,143 @@
+package filesystem
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// maxXattrNameLen is the longest name an extended attribute can have.
+	maxXattrNameLen = 255
+	// xattrHeaderSize is the size of the name and value lengths preceding each
+	// attribute.
+	xattrHeaderSize = 1 + 2
+)
+
+var (
+	// errNoXattr is returned for extended attributes which do not exist.
+	errNoXattr = errors.New("No such attribute")
+	// errXattrTooBig is returned when the extended attributes of an inode
+	// would no longer fit within their block.
+	errXattrTooBig = errors.New("Attributes too large")
+)
+
+// xattr is an extended attribute of an inode. The extended attributes of an
+// inode are held in a single metadata block, so they are limited to blockSize
+// bytes in total, counting xattrHeaderSize bytes and the name of each. Each
+// attribute is stored as the name length, the value length and then the name
+// and value, the attributes end with a zero name length.
+type xattr struct {
+	name  string
+	value []byte
+}
+
+// readXattrs returns the extended attributes of n.
+func (f *fs) readXattrs(n *inode) ([]xattr, error) {
+	if n.Xattr == 0 {
+		return nil, nil
+	}
+	b := make([]byte, blockSize)
+	if err := f.readBlock(n.Xattr, b); err != nil {
+		return nil, err
+	}
+	var attrs []xattr
+	for len(b) >= xattrHeaderSize && b[0] != 0 {
+		nameLen, valueLen := int(b[0]), int(binary.LittleEndian.Uint16(b[1:]))
+		b = b[xattrHeaderSize:]
+		if nameLen+valueLen > len(b) {
+			break
+		}
+		attrs = append(attrs, xattr{
+			name:  string(b[:nameLen]),
+			value: append([]byte{}, b[nameLen:nameLen+valueLen]...),
+		})
+		b = b[nameLen+valueLen:]
+	}
+	return attrs, nil
+}
+
+// writeXattrs replaces the extended attributes of n, allocating or freeing its
+// attribute block as needed. The caller must write back n.
+func (f *fs) writeXattrs(n *inode, attrs []xattr) error {
+	if len(attrs) == 0 {
+		return f.freeXattrs(n)
+	}
+	b := make([]byte, 0, blockSize)
+	for _, a := range attrs {
+		b = append(b, byte(len(a.name)), 0, 0)
+		binary.LittleEndian.PutUint16(b[len(b)-2:], uint16(len(a.value)))
+		b = append(append(b, a.name...), a.value...)
+	}
+	if len(b) > blockSize {
+		return errXattrTooBig
+	}
+	if n.Xattr == 0 {
+		blk, err := f.allocBlock()
+		if err != nil {
+			return err
+		}
+		n.Xattr = blk
+	}
+	return f.writeAt(append(b, make([]byte, blockSize-len(b))...), int64(n.Xattr)*blockSize, true)
+}
+
+// freeXattrs removes all extended attributes of n. The caller must write back
+// n.
+func (f *fs) freeXattrs(n *inode) error {
+	if n.Xattr == 0 {
+		return nil
+	}
+	if err := f.freeBlock(n.Xattr); err != nil {
+		return err
+	}
+	n.Xattr = 0
+	return nil
+}
+
+// setXattr sets the extended attribute name of n. If create is true an existing
+// attribute is not replaced, if replace is true a new attribute is not created.
+// The caller must write back n.
+func (f *fs) setXattr(n *inode, name string, value []byte, create, replace bool) error {
+	if name == "" {
+		return errInvalid
+	}
+	if len(name) > maxXattrNameLen {
+		return errNameTooLong
+	}
+	if len(value) > blockSize {
+		return errXattrTooBig
+	}
+	attrs, err := f.readXattrs(n)
+	if err != nil {
+		return err
+	}
+	a := xattr{name, append([]byte{}, value...)}
+	for i := range attrs {
+		if attrs[i].name == name {
+			if create {
+				return errExists
+			}
+			attrs[i] = a
+			return f.writeXattrs(n, attrs)
+		}
+	}
+	if replace {
+		return errNoXattr
+	}
+	return f.writeXattrs(n, append(attrs, a))
+}
+
+// removeXattr removes the extended attribute name of n. The caller must write
+// back n.
+func (f *fs) removeXattr(n *inode, name string) error {
+	attrs, err := f.readXattrs(n)
+	if err != nil {
+		return err
+	}
+	for i := range attrs {
+		if attrs[i].name == name {
+			return f.writeXattrs(n, append(attrs[:i], attrs[i+1:]...))
+		}
+	}
+	return errNoXattr
+}
@@ -0,0 +1,9 @@
+module stegasis
+
+go 1.22
+
+require (
+	github.com/aead/serpent v0.0.0-20160714141033-fba169763ea6
+	github.com/billziss-gh/cgofuse v1.5.0
+	golang.org/x/crypto v0.33.0
+)
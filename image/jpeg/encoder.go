@@ -2,12 +2,14 @@ package jpeg
 
 import (
 	"bufio"
-	"os"
+	"io"
 )
 
 // encode actually does the encoding work.
-func (jp *JPEG) encode(f *os.File) error {
-	bw := bufio.NewWriter(f)
+func (jp *JPEG) encode(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	// Bits left over from a previous encode must not leak into this one.
+	jp.eBits, jp.eNBits = 0, 0
 
 	buff := make([]byte, 1024)
 
@@ -70,7 +72,10 @@ func (jp *JPEG) encode(f *os.File) error {
 			_ = jp.writeBlock(bw, &b, 1, 0)
 		}
 	}
-	jp.emit(bw, 0x7f, 7)
+	// Pad the final partial byte with 1 bits.
+	if jp.eNBits > 0 {
+		jp.emit(bw, 1<<(8-jp.eNBits)-1, 8-jp.eNBits)
+	}
 
 	// Write the End Of Image marker.
 	buff[0] = 0xff
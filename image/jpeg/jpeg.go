@@ -47,15 +47,24 @@ func DecodeJPEG(r io.Reader, path string) (*JPEG, error) {
 
 // Encode encodes the current JPEG data and writes it out as a jpeg file to the
 // filePath provided when the JPEG was created (i.e. it overwrites the current
-// jpeg on disk).
+// jpeg on disk). The JPEG is no longer dirty once encoded.
 func (jp *JPEG) Encode() error {
-	f, err := os.OpenFile(jp.path, os.O_RDWR, 0755)
+	f, err := os.OpenFile(jp.path, os.O_RDWR|os.O_TRUNC, 0755)
 	if err != nil {
 		return fmt.Errorf("Could not open %q to write: %v", jp.path, err)
 	}
 	defer f.Close()
+	return jp.EncodeTo(f)
+}
 
-	return jp.encode(f)
+// EncodeTo encodes the current JPEG data as a jpeg file written to w. The JPEG
+// is no longer dirty once encoded.
+func (jp *JPEG) EncodeTo(w io.Writer) error {
+	if err := jp.encode(w); err != nil {
+		return err
+	}
+	jp.dirty = false
+	return nil
 }
 
 // Size returns the total number of DCT coefficients in all blocks.
@@ -0,0 +1,74 @@
+package jpeg
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// newTestJPEG returns a decoded JPEG of w by h 16 pixel macroblocks holding
+// random coefficients, laid out in 4:2:0 as FFMPEG produces them. The same
+// seed always gives the same JPEG.
+func newTestJPEG(t *testing.T, seed int64, w, h int) *JPEG {
+	r := rand.New(rand.NewSource(seed))
+	src := &JPEG{
+		width:  w * 16,
+		height: h * 16,
+	}
+	for i := range src.quant[0] {
+		src.quant[0][i] = 1
+	}
+	for m := 0; m < w*h; m++ {
+		for _, c := range []int{0, 0, 0, 0, 1, 2} {
+			var b block
+			for k := range b {
+				b[k] = int32(r.NormFloat64() * 4)
+			}
+			src.blocks = append(src.blocks, b)
+			src.compIndex = append(src.compIndex, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := src.EncodeTo(&buf); err != nil {
+		t.Fatalf("Failed to encode test JPEG: %v", err)
+	}
+	j, err := DecodeJPEG(&buf, "")
+	if err != nil {
+		t.Fatalf("Failed to decode test JPEG: %v", err)
+	}
+	checkEqual(t, src, j)
+	return j
+}
+
+// checkEqual fails t unless a and b hold the same DCT coefficients.
+func checkEqual(t *testing.T, a, b *JPEG) {
+	if a.Size() != b.Size() {
+		t.Fatalf("Size %d, expected %d", b.Size(), a.Size())
+	}
+	for i := 0; i < a.Size(); i++ {
+		if a.GetElement(i) != b.GetElement(i) {
+			t.Fatalf("Coefficient %d is %d, expected %d", i, b.GetElement(i), a.GetElement(i))
+		}
+	}
+}
+
+func TestEncodeTwice(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		j := newTestJPEG(t, seed, 3, 2)
+		j.SetElement(1, j.GetElement(1)+1)
+		for n := 0; n < 2; n++ {
+			var buf bytes.Buffer
+			if err := j.EncodeTo(&buf); err != nil {
+				t.Fatalf("Seed %d, encode %d: %v", seed, n, err)
+			}
+			if j.IsDirty() {
+				t.Errorf("Seed %d, encode %d: still dirty after encoding", seed, n)
+			}
+			got, err := DecodeJPEG(&buf, "")
+			if err != nil {
+				t.Fatalf("Seed %d, encode %d: failed to decode: %v", seed, n, err)
+			}
+			checkEqual(t, j, got)
+		}
+	}
+}
@@ -1,5 +1,8 @@
 // Stagasis provides steganographic embeding of data within video files as a file system.
-// Usage: stegasis --framerate=25 path\to\video.mp4
+// Usage:
+//
+//	stegasis format [-f] --alg=<alg> [--crypt=<alg>] --pass=<pass> [--pass2=<pass2>] --cap=<capacity> [--frames=<storage>] <video_path>
+//	stegasis mount [-p,-f] --alg=<alg> [--crypt=<alg>] --pass=<pass> [--pass2=<pass2>] [--frames=<storage>] <video_path> <mount_point>
 package main
 
 import (
@@ -9,26 +12,151 @@ import (
 
 	"stegasis/filesystem"
 	"stegasis/video"
+	"stegasis/volume"
 
 	"github.com/billziss-gh/cgofuse/fuse"
 )
 
-var (
-	frameRate = flag.Int("framerate", 0, "Frame rate of the input video, if known.")
-)
-
 func main() {
-	flag.Parse()
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "format":
+		err = format(os.Args[2:])
+	case "mount":
+		err = mount(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Printf("Usage: stegasis <format|mount> [flags] <video_path> [mount_point]\n")
+	os.Exit(2)
+}
 
-	codec := video.NewMotionJPEGCodec(flag.Args()[0], video.MotionJPEGCodecOptions{
-		FrameRate: *frameRate,
+// newCodec returns the codec used for the video at path. Uncompressed AVI files
+// are handled directly unless force is set, everything else is decoded with
+// FFmpeg and the extracted frames kept as given by storage.
+func newCodec(path string, force bool, frameRate int, storage string) (video.Codec, error) {
+	if !force && video.IsUncompressedAVI(path) {
+		return video.NewAVICodec(path), nil
+	}
+	s, err := video.ParseFrameStorage(storage)
+	if err != nil {
+		return nil, err
+	}
+	return video.NewMotionJPEGCodec(path, video.MotionJPEGCodecOptions{
+		FrameRate: frameRate,
+		Storage:   s,
+	}), nil
+}
+
+// format prepares a video for use with stegasis.
+func format(args []string) error {
+	flags := flag.NewFlagSet("format", flag.ExitOnError)
+	alg := flags.String("alg", "", "Embedding algorithm to use.")
+	crypt := flags.String("crypt", "", "Cryptographic algorithm used to encrypt embedded data.")
+	pass := flags.String("pass", "", "Passphrase used for encrypting and permuting data.")
+	pass2 := flags.String("pass2", "", "Passphrase used for encrypting and permuting the hidden volume.")
+	capacity := flags.Int("cap", 100, "Percentage of frame to embed within.")
+	force := flags.Bool("f", false, "Force FFmpeg decoder to be used.")
+	frames := flags.String("frames", "disk", "Where extracted frames are kept: disk, encrypted or memory.")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: stegasis format [-f] --alg=<alg> [--crypt=<alg>] --pass=<pass> [--pass2=<pass2>] --cap=<capacity> [--frames=<storage>] <video_path>")
+	}
+
+	codec, err := newCodec(flags.Arg(0), *force, 0, *frames)
+	if err != nil {
+		return err
+	}
+	defer codec.Close()
+	if err := codec.Decode(); err != nil {
+		return fmt.Errorf("Codec failed to decode: %v", err)
+	}
+
+	v, err := volume.Format(codec, volume.Options{
+		Alg:   *alg,
+		Crypt: *crypt,
+		Pass:  *pass,
+		Pass2: *pass2,
+		Cap:   *capacity,
 	})
+	if err != nil {
+		return fmt.Errorf("Failed to format volume: %v", err)
+	}
+	if err := filesystem.Format(v); err != nil {
+		return fmt.Errorf("Failed to format filesystem: %v", err)
+	}
+	if hidden := v.Hidden(); hidden != nil {
+		if err := filesystem.Format(hidden); err != nil {
+			return fmt.Errorf("Failed to format hidden filesystem: %v", err)
+		}
+		fmt.Printf("Formatted hidden volume with %d bytes of capacity.\n", hidden.Size())
+	}
+
+	if err := codec.Encode(); err != nil {
+		return fmt.Errorf("Codec failed to encode: %v", err)
+	}
+	fmt.Printf("Formatted %q with %d bytes of capacity.\n", flags.Arg(0), v.Size())
+	return nil
+}
+
+// mount mounts a formatted video at the given mount point until unmounted.
+func mount(args []string) error {
+	flags := flag.NewFlagSet("mount", flag.ExitOnError)
+	alg := flags.String("alg", "", "Embedding algorithm the video was formatted with.")
+	crypt := flags.String("crypt", "", "Cryptographic algorithm the video was formatted with.")
+	pass := flags.String("pass", "", "Passphrase used for encrypting and permuting data.")
+	pass2 := flags.String("pass2", "", "Passphrase used for encrypting and permuting the hidden volume.")
+	frameRate := flags.Int("framerate", 0, "Frame rate of the input video, if known.")
+	deferred := flags.Bool("p", false, "Do not flush writes to disk until unmount or the journal fills.")
+	force := flags.Bool("f", false, "Force FFmpeg decoder to be used.")
+	frames := flags.String("frames", "disk", "Where extracted frames are kept: disk, encrypted or memory.")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return fmt.Errorf("Usage: stegasis mount [-p,-f] --alg=<alg> [--crypt=<alg>] --pass=<pass> [--pass2=<pass2>] [--frames=<storage>] <video_path> <mount_point>")
+	}
+
+	codec, err := newCodec(flags.Arg(0), *force, *frameRate, *frames)
+	if err != nil {
+		return err
+	}
+	defer codec.Close()
 	if err := codec.Decode(); err != nil {
-		fmt.Printf("Codec failed to decode: %v", err)
-		os.Exit(1)
+		return fmt.Errorf("Codec failed to decode: %v", err)
 	}
 
-	fs := filesystem.New(codec)
+	v, err := volume.Open(codec, volume.Options{
+		Alg:   *alg,
+		Crypt: *crypt,
+		Pass:  *pass,
+		Pass2: *pass2,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to open volume: %v", err)
+	}
+
+	policy := filesystem.WriteThrough
+	if *deferred {
+		policy = filesystem.Deferred
+	}
+	fs, err := filesystem.New(codec, v, policy)
+	if err != nil {
+		return fmt.Errorf("Failed to open filesystem: %v", err)
+	}
 	host := fuse.NewFileSystemHost(fs)
-	host.Mount("X:", flag.Args()[1:])
+	fmt.Printf("Mounting %q at %q, press Ctrl-C to unmount.\n", flags.Arg(0), flags.Arg(1))
+	if !host.Mount(flags.Arg(1), nil) {
+		return fmt.Errorf("Failed to mount %q", flags.Arg(1))
+	}
+	return nil
 }
@@ -0,0 +1,337 @@
+package video
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// biRGB is the BITMAPINFOHEADER compression value for uncompressed RGB data.
+const biRGB = 0
+
+// aviCodec reads and writes uncompressed RGB/BGR AVI files directly. Frames
+// are read from the file when first used and modified in place within the file
+// so round tripping is lossless. aviCodec implements the Codec interface.
+type aviCodec struct {
+	filePath string
+	file     *os.File
+	chunks   []aviChunk
+	rowBytes int
+	stride   int
+	height   int
+	// frames holds the frames read from the file. Once more than
+	// defaultCachedFrames are held the unmodified frames are dropped, modified
+	// frames are held until Encode writes them back.
+	frames map[int]*aviFrame
+}
+
+// aviFrame holds the pixel data of a single uncompressed frame and implements
+// the Frame interface. Elements are the individual channel bytes of each pixel,
+// row padding is not exposed.
+type aviFrame struct {
+	codec *aviCodec
+	i     int
+	data  []byte
+	dirty bool
+}
+
+// aviStream describes the uncompressed video stream of an AVI file.
+type aviStream struct {
+	index    int
+	width    int
+	height   int
+	bitCount int
+	// chunks holds the file offset and size of every frame in the stream.
+	chunks []aviChunk
+}
+
+type aviChunk struct {
+	offset int64
+	size   int
+}
+
+// IsUncompressedAVI returns true iff the file at path is an AVI file holding an
+// uncompressed RGB video stream which NewAVICodec can handle.
+func IsUncompressedAVI(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	_, err = parseAVI(f)
+	return err == nil
+}
+
+// Decode parses the AVI file, frames are read by GetFrame.
+func (c *aviCodec) Decode() error {
+	f, err := os.OpenFile(c.filePath, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to open %q: %v", c.filePath, err)
+	}
+	c.file = f
+
+	s, err := parseAVI(f)
+	if err != nil {
+		return fmt.Errorf("Failed to parse AVI %q: %v", c.filePath, err)
+	}
+
+	c.rowBytes = s.width * s.bitCount / 8
+	c.stride = (c.rowBytes + 3) &^ 3
+	c.height = s.height
+	for i, ch := range s.chunks {
+		if ch.size < c.stride*c.height {
+			return fmt.Errorf("Frame %d is %d bytes, expected %d", i, ch.size, c.stride*c.height)
+		}
+	}
+	c.chunks = s.chunks
+	c.frames = make(map[int]*aviFrame)
+	fmt.Printf("Found %d uncompressed frames in %q\n", len(c.chunks), c.filePath)
+	return nil
+}
+
+// Encode writes every modified frame back into the AVI file in place.
+func (c *aviCodec) Encode() error {
+	for i, f := range c.frames {
+		if !f.dirty {
+			continue
+		}
+		if _, err := c.file.WriteAt(f.data, c.chunks[i].offset); err != nil {
+			return fmt.Errorf("Failed to write frame %d: %v", i, err)
+		}
+		f.dirty = false
+	}
+	return c.file.Sync()
+}
+
+// GetFrame returns the ith frame. Panics if i >= Frames() or i < 0.
+func (c *aviCodec) GetFrame(i int) (Frame, error) {
+	if i < 0 {
+		panic(fmt.Errorf("GetFrame %d cannot be negative", i))
+	}
+	if i >= c.Frames() {
+		panic(fmt.Errorf("GetFrame %d is larger than total frame count %d", i, c.Frames()))
+	}
+	if f, ok := c.frames[i]; ok {
+		return f, nil
+	}
+	f := &aviFrame{codec: c, i: i, data: make([]byte, c.stride*c.height)}
+	if _, err := c.file.ReadAt(f.data, c.chunks[i].offset); err != nil {
+		return nil, fmt.Errorf("Failed to read frame %d: %v", i, err)
+	}
+	if len(c.frames) >= defaultCachedFrames {
+		for j, f := range c.frames {
+			if !f.dirty {
+				delete(c.frames, j)
+			}
+		}
+	}
+	c.frames[i] = f
+	return f, nil
+}
+
+// ElementType implements Codec, the frames hold uncompressed pixels.
+func (c *aviCodec) ElementType() ElementType {
+	return Pixels
+}
+
+// Frames returns the number of frames within the video file.
+func (c *aviCodec) Frames() int {
+	return len(c.chunks)
+}
+
+// Close closes the AVI file.
+func (c *aviCodec) Close() {
+	if c.file != nil {
+		c.file.Close()
+	}
+}
+
+// NewAVICodec returns a new uncompressed AVI codec.
+func NewAVICodec(path string) Codec {
+	return &aviCodec{
+		filePath: path,
+	}
+}
+
+// Size returns the number of pixel channel bytes in the frame.
+func (f *aviFrame) Size() int {
+	return f.codec.rowBytes * f.codec.height
+}
+
+// GetElement returns the ith pixel channel byte.
+func (f *aviFrame) GetElement(i int) int {
+	return int(f.data[f.index(i)])
+}
+
+// SetElement sets the ith pixel channel byte to val. A modified frame is held
+// by the codec until written back, even if it was dropped while in use.
+func (f *aviFrame) SetElement(i, val int) {
+	f.data[f.index(i)] = byte(val)
+	if !f.dirty {
+		f.dirty = true
+		f.codec.frames[f.i] = f
+	}
+}
+
+// IsDirty returns true if the frame has been modified since it was last
+// written.
+func (f *aviFrame) IsDirty() bool {
+	return f.dirty
+}
+
+// index maps the ith element onto its offset within data, skipping row
+// padding.
+func (f *aviFrame) index(i int) int {
+	if i < 0 {
+		panic(fmt.Errorf("AVI frame element i < 0: %d", i))
+	}
+	if i >= f.Size() {
+		panic(fmt.Errorf("AVI frame element i >= Size(). Size: %d, i: %d", f.Size(), i))
+	}
+	return i/f.codec.rowBytes*f.codec.stride + i%f.codec.rowBytes
+}
+
+// parseAVI walks the RIFF structure of an AVI file, including any OpenDML
+// AVIX extensions, and returns its uncompressed video stream.
+func parseAVI(r io.ReadSeeker) (*aviStream, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	var s *aviStream
+	for off := int64(0); off+12 <= size; {
+		id, n, err := readChunkHeader(r, off)
+		if err != nil {
+			return nil, err
+		}
+		form, err := readFourCC(r)
+		if err != nil {
+			return nil, err
+		}
+		if id != "RIFF" || (off == 0 && form != "AVI ") || (off != 0 && form != "AVIX") {
+			return nil, fmt.Errorf("Not an AVI file")
+		}
+		if s, err = parseList(r, off+12, off+8+int64(n), s); err != nil {
+			return nil, err
+		}
+		off += 8 + int64(n+n&1)
+	}
+	if s == nil {
+		return nil, fmt.Errorf("No uncompressed video stream found")
+	}
+	return s, nil
+}
+
+// parseList parses the chunks in [start, end), descending into LISTs.
+func parseList(r io.ReadSeeker, start, end int64, s *aviStream) (*aviStream, error) {
+	streamIndex := -1
+	for off := start; off+8 <= end; {
+		id, n, err := readChunkHeader(r, off)
+		if err != nil {
+			return nil, err
+		}
+		data := off + 8
+
+		switch {
+		case id == "LIST":
+			listType, err := readFourCC(r)
+			if err != nil {
+				return nil, err
+			}
+			if listType == "strl" {
+				streamIndex++
+				if s, err = parseStream(r, data+4, data+int64(n), streamIndex, s); err != nil {
+					return nil, err
+				}
+			} else if s, err = parseList(r, data+4, data+int64(n), s); err != nil {
+				return nil, err
+			}
+		case s != nil && len(id) == 4 && (id[2:] == "db" || id[2:] == "dc") && id[:2] == fmt.Sprintf("%02d", s.index):
+			if n > 0 {
+				s.chunks = append(s.chunks, aviChunk{offset: data, size: int(n)})
+			}
+		}
+		off = data + int64(n+n&1)
+	}
+	return s, nil
+}
+
+// parseStream parses a strl LIST, returning the stream if it is the first
+// uncompressed video stream found.
+func parseStream(r io.ReadSeeker, start, end int64, index int, s *aviStream) (*aviStream, error) {
+	var fccType string
+	for off := start; off+8 <= end; {
+		id, n, err := readChunkHeader(r, off)
+		if err != nil {
+			return nil, err
+		}
+		switch id {
+		case "strh":
+			if fccType, err = readFourCC(r); err != nil {
+				return nil, err
+			}
+		case "strf":
+			if fccType != "vids" || s != nil {
+				break
+			}
+			var bih struct {
+				Size          uint32
+				Width         int32
+				Height        int32
+				Planes        uint16
+				BitCount      uint16
+				Compression   uint32
+				SizeImage     uint32
+				XPelsPerMeter int32
+				YPelsPerMeter int32
+				ClrUsed       uint32
+				ClrImportant  uint32
+			}
+			if err := binary.Read(r, binary.LittleEndian, &bih); err != nil {
+				return nil, err
+			}
+			if bih.Compression != biRGB || (bih.BitCount != 24 && bih.BitCount != 32) {
+				return nil, fmt.Errorf("Video stream is not uncompressed 24 or 32 bit RGB")
+			}
+			height := int(bih.Height)
+			if height < 0 {
+				// Top down bitmap.
+				height = -height
+			}
+			s = &aviStream{
+				index:    index,
+				width:    int(bih.Width),
+				height:   height,
+				bitCount: int(bih.BitCount),
+			}
+		}
+		off += 8 + int64(n+n&1)
+	}
+	return s, nil
+}
+
+// readChunkHeader seeks to off and reads a chunk id and size.
+func readChunkHeader(r io.ReadSeeker, off int64) (string, uint32, error) {
+	if _, err := r.Seek(off, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	id, err := readFourCC(r)
+	if err != nil {
+		return "", 0, err
+	}
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return "", 0, err
+	}
+	return id, n, nil
+}
+
+func readFourCC(r io.Reader) (string, error) {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
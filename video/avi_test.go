@@ -0,0 +1,190 @@
+package video
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+// testAVI describes an uncompressed AVI file, built by bytes.
+type testAVI struct {
+	width, height int
+	bitCount      int
+	compression   uint32
+	// frames holds the data of every frame, the first riffFrames are in the
+	// RIFF AVI chunk and the rest in an AVIX chunk.
+	frames     [][]byte
+	riffFrames int
+}
+
+func aviChunkBytes(id string, data ...[]byte) []byte {
+	b := bytes.Join(data, nil)
+	out := append([]byte(id), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(b)))
+	out = append(out, b...)
+	if len(b)%2 == 1 {
+		out = append(out, 0)
+	}
+	return out
+}
+
+func aviListBytes(id, listType string, chunks ...[]byte) []byte {
+	return aviChunkBytes(id, append([][]byte{[]byte(listType)}, chunks...)...)
+}
+
+// bytes returns the AVI file, holding an audio stream before the video stream
+// with its chunks interleaved between the frames.
+func (a testAVI) bytes() []byte {
+	var bih bytes.Buffer
+	binary.Write(&bih, binary.LittleEndian, struct {
+		Size          uint32
+		Width, Height int32
+		Planes        uint16
+		BitCount      uint16
+		Compression   uint32
+		Rest          [20]byte
+	}{40, int32(a.width), int32(a.height), 1, uint16(a.bitCount), a.compression, [20]byte{}})
+	strh := func(fccType string) []byte {
+		return aviChunkBytes("strh", []byte(fccType), make([]byte, 52))
+	}
+	hdrl := aviListBytes("LIST", "hdrl",
+		aviChunkBytes("avih", make([]byte, 56)),
+		aviListBytes("LIST", "strl", strh("auds"), aviChunkBytes("strf", make([]byte, 18))),
+		aviListBytes("LIST", "strl", strh("vids"), aviChunkBytes("strf", bih.Bytes())),
+	)
+	movi := func(frames [][]byte) []byte {
+		var chunks [][]byte
+		for _, f := range frames {
+			chunks = append(chunks, aviChunkBytes("01dc", f), aviChunkBytes("00wb", make([]byte, 7)))
+		}
+		// Dropped frames are empty chunks.
+		chunks = append(chunks, aviChunkBytes("01dc"))
+		return aviListBytes("LIST", "movi", chunks...)
+	}
+	avi := aviListBytes("RIFF", "AVI ",
+		hdrl,
+		aviChunkBytes("JUNK", make([]byte, 5)),
+		movi(a.frames[:a.riffFrames]),
+		aviChunkBytes("idx1", make([]byte, 16)),
+	)
+	if a.riffFrames < len(a.frames) {
+		avi = append(avi, aviListBytes("RIFF", "AVIX", movi(a.frames[a.riffFrames:]))...)
+	}
+	return avi
+}
+
+// newTestAVI returns a 24 bit AVI of n frames of random pixels, whose rows of
+// 5 pixels are padded to 16 bytes.
+func newTestAVI(n, riffFrames int) testAVI {
+	r := rand.New(rand.NewSource(int64(n)))
+	a := testAVI{width: 5, height: 3, bitCount: 24, riffFrames: riffFrames}
+	for i := 0; i < n; i++ {
+		f := make([]byte, 16*3)
+		r.Read(f)
+		a.frames = append(a.frames, f)
+	}
+	return a
+}
+
+func TestParseAVI(t *testing.T) {
+	a := newTestAVI(5, 3)
+	a.height = -3
+	b := a.bytes()
+	s, err := parseAVI(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.index != 1 || s.width != 5 || s.height != 3 || s.bitCount != 24 {
+		t.Errorf("Parsed stream %d of %dx%d %d bit, expected stream 1 of 5x3 24 bit", s.index, s.width, s.height, s.bitCount)
+	}
+	if len(s.chunks) != len(a.frames) {
+		t.Fatalf("Found %d frames, expected %d", len(s.chunks), len(a.frames))
+	}
+	for i, ch := range s.chunks {
+		if got := b[ch.offset : ch.offset+int64(ch.size)]; !bytes.Equal(got, a.frames[i]) {
+			t.Errorf("Frame %d at %d does not hold the frame data", i, ch.offset)
+		}
+	}
+}
+
+func TestParseAVIRejects(t *testing.T) {
+	compressed := newTestAVI(1, 1)
+	compressed.compression = 1
+	bits16 := newTestAVI(1, 1)
+	bits16.bitCount = 16
+	notAVI := newTestAVI(1, 1).bytes()
+	copy(notAVI[8:], "WAVE")
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"compressed", compressed.bytes()},
+		{"16 bit", bits16.bytes()},
+		{"not an AVI", notAVI},
+		{"no video", aviListBytes("RIFF", "AVI ", aviListBytes("LIST", "movi"))},
+	} {
+		if _, err := parseAVI(bytes.NewReader(tc.data)); err == nil {
+			t.Errorf("%s: parsed", tc.name)
+		}
+	}
+}
+
+// TestAVIEncode checks elements skip row padding, and that Encode writes only
+// the modified frames back in place.
+func TestAVIEncode(t *testing.T) {
+	a := newTestAVI(4, 2)
+	path := filepath.Join(t.TempDir(), "video.avi")
+	want := a.bytes()
+	if err := ioutil.WriteFile(path, want, 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := parseAVI(bytes.NewReader(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewAVICodec(path)
+	if err := c.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.Frames() != len(a.frames) {
+		t.Fatalf("Decoded %d frames, expected %d", c.Frames(), len(a.frames))
+	}
+	f, err := c.GetFrame(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Size() != 15*3 {
+		t.Fatalf("Frame holds %d elements, expected %d", f.Size(), 15*3)
+	}
+	// Element 15 is the first byte of the second row, after one byte of
+	// padding.
+	for _, i := range []int{0, 14, 15, 44} {
+		off := i/15*16 + i%15
+		if f.GetElement(i) != int(a.frames[3][off]) {
+			t.Errorf("Element %d is %d, expected %d", i, f.GetElement(i), a.frames[3][off])
+		}
+		f.SetElement(i, f.GetElement(i)^0xff)
+		want[s.chunks[3].offset+int64(off)] ^= 0xff
+	}
+	if !f.IsDirty() {
+		t.Error("Modified frame is not dirty")
+	}
+	if err := c.Encode(); err != nil {
+		t.Fatal(err)
+	}
+	if f.IsDirty() {
+		t.Error("Encoded frame is still dirty")
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("Encoded AVI does not match the original with the modified frame")
+	}
+}
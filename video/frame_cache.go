@@ -0,0 +1,115 @@
+package video
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+
+	"stegasis/image/jpeg"
+)
+
+// frameCache holds the most recently used decoded frames of a video, so only a
+// bounded number of frames are held in memory at once. Dirty frames are pinned
+// in the cache, once only dirty frames remain to be evicted they are encoded to
+// the frame store first so modifications are never dropped.
+type frameCache struct {
+	capacity int
+	store    frameStore
+	// lru holds a *cacheEntry for each cached frame, most recently used
+	// first.
+	lru     *list.List
+	entries map[int]*list.Element
+}
+
+type cacheEntry struct {
+	i     int
+	frame *jpeg.JPEG
+}
+
+func newFrameCache(capacity int, store frameStore) *frameCache {
+	return &frameCache{
+		capacity: capacity,
+		store:    store,
+		lru:      list.New(),
+		entries:  make(map[int]*list.Element),
+	}
+}
+
+// get returns frame i, nil if it is not cached.
+func (fc *frameCache) get(i int) *jpeg.JPEG {
+	e, ok := fc.entries[i]
+	if !ok {
+		return nil
+	}
+	fc.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).frame
+}
+
+// add adds frame i to the cache, evicting the least recently used frames
+// beyond the capacity of the cache.
+func (fc *frameCache) add(i int, frame *jpeg.JPEG) error {
+	fc.put(i, frame)
+	return fc.evict()
+}
+
+// put adds frame i to the cache as the most recently used frame, without
+// evicting any frames.
+func (fc *frameCache) put(i int, frame *jpeg.JPEG) {
+	if e, ok := fc.entries[i]; ok {
+		e.Value.(*cacheEntry).frame = frame
+		fc.lru.MoveToFront(e)
+	} else {
+		fc.entries[i] = fc.lru.PushFront(&cacheEntry{i, frame})
+	}
+}
+
+// evict removes frames until the cache is within its capacity. Clean frames are
+// evicted first, dirty frames only once they have been encoded. The most
+// recently used frame is never evicted.
+func (fc *frameCache) evict() error {
+	for e := fc.lru.Back(); e != fc.lru.Front() && fc.lru.Len() > fc.capacity; {
+		prev := e.Prev()
+		if !e.Value.(*cacheEntry).frame.IsDirty() {
+			fc.remove(e)
+		}
+		e = prev
+	}
+	for e := fc.lru.Back(); e != fc.lru.Front() && fc.lru.Len() > fc.capacity; {
+		prev := e.Prev()
+		if err := fc.encodeFrame(e.Value.(*cacheEntry)); err != nil {
+			return err
+		}
+		fc.remove(e)
+		e = prev
+	}
+	return nil
+}
+
+func (fc *frameCache) remove(e *list.Element) {
+	delete(fc.entries, e.Value.(*cacheEntry).i)
+	fc.lru.Remove(e)
+}
+
+// encode encodes every dirty frame to the frame store.
+func (fc *frameCache) encode() error {
+	for e := fc.lru.Front(); e != nil; e = e.Next() {
+		if ent := e.Value.(*cacheEntry); ent.frame.IsDirty() {
+			if err := fc.encodeFrame(ent); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// encodeFrame encodes the frame of ent to the frame store.
+func (fc *frameCache) encodeFrame(ent *cacheEntry) error {
+	var b bytes.Buffer
+	if err := ent.frame.EncodeTo(&b); err != nil {
+		return fmt.Errorf("Failed to encode frame %d: %v", ent.i, err)
+	}
+	if err := fc.store.write(ent.i, b.Bytes()); err != nil {
+		return fmt.Errorf("Failed to store frame %d: %v", ent.i, err)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package video
+
+import (
+	"bytes"
+	"testing"
+
+	"stegasis/image/jpeg"
+)
+
+// newTestCache returns a cache of the given capacity over a store of n
+// frames, along with the decoded frames.
+func newTestCache(t *testing.T, capacity, n int) (*frameCache, *memoryStore, []*jpeg.JPEG) {
+	s := &memoryStore{}
+	var frames []*jpeg.JPEG
+	for i := 0; i < n; i++ {
+		b := newTestJPEG(t, int64(i), 32, 16)
+		if err := s.write(i, b); err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, decodeTestJPEG(t, b))
+	}
+	return newFrameCache(capacity, s), s, frames
+}
+
+// checkCached fails t unless exactly the given frames are cached.
+func checkCached(t *testing.T, fc *frameCache, frames []*jpeg.JPEG, cached ...int) {
+	t.Helper()
+	if fc.lru.Len() != len(cached) {
+		t.Errorf("Cache holds %d frames, expected %d", fc.lru.Len(), len(cached))
+	}
+	for _, i := range cached {
+		if fc.get(i) != frames[i] {
+			t.Errorf("Frame %d is not cached", i)
+		}
+	}
+}
+
+func TestFrameCacheEviction(t *testing.T) {
+	fc, _, frames := newTestCache(t, 2, 4)
+	for i := 0; i < 3; i++ {
+		if err := fc.add(i, frames[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fc.get(0) != nil {
+		t.Error("Least recently used frame 0 was not evicted")
+	}
+	checkCached(t, fc, frames, 2, 1)
+
+	// Frame 1 is now the most recently used, so 2 goes next.
+	if err := fc.add(3, frames[3]); err != nil {
+		t.Fatal(err)
+	}
+	if fc.get(2) != nil {
+		t.Error("Least recently used frame 2 was not evicted")
+	}
+	checkCached(t, fc, frames, 1, 3)
+}
+
+// TestFrameCacheDirty checks dirty frames are pinned while clean frames remain
+// to be evicted, and are written to the store before being evicted.
+func TestFrameCacheDirty(t *testing.T) {
+	fc, s, frames := newTestCache(t, 2, 4)
+	for i := 0; i < 2; i++ {
+		if err := fc.add(i, frames[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	frames[0].SetElement(0, frames[0].GetElement(0)+1)
+	before, err := s.read(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before = append([]byte{}, before...)
+
+	if err := fc.add(2, frames[2]); err != nil {
+		t.Fatal(err)
+	}
+	if fc.get(1) != nil {
+		t.Error("Clean frame 1 was not evicted before dirty frame 0")
+	}
+	checkCached(t, fc, frames, 0, 2)
+	if b, _ := s.read(0); !bytes.Equal(b, before) {
+		t.Error("Dirty frame 0 was written while clean frames remained")
+	}
+
+	// Once only dirty frames remain they are written before being evicted.
+	frames[2].SetElement(0, frames[2].GetElement(0)+1)
+	if err := fc.add(3, frames[3]); err != nil {
+		t.Fatal(err)
+	}
+	if fc.get(0) != nil {
+		t.Error("Dirty frame 0 was not evicted")
+	}
+	checkCached(t, fc, frames, 2, 3)
+	if frames[0].IsDirty() {
+		t.Error("Evicted frame 0 is still dirty")
+	}
+	b, err := s.read(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := decodeTestJPEG(t, b); got.GetElement(0) != frames[0].GetElement(0) {
+		t.Errorf("Stored frame 0 element is %d, expected %d", got.GetElement(0), frames[0].GetElement(0))
+	}
+}
+
+// TestFrameCacheEncodeTwice checks encoding the cache only writes dirty
+// frames, and that a frame modified and encoded again is stored intact.
+func TestFrameCacheEncodeTwice(t *testing.T) {
+	fc, s, frames := newTestCache(t, 4, 3)
+	for i := 0; i < 3; i++ {
+		if err := fc.add(i, frames[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for n := 0; n < 2; n++ {
+		frames[1].SetElement(n, frames[1].GetElement(n)+1)
+		if err := fc.encode(); err != nil {
+			t.Fatal(err)
+		}
+		if frames[1].IsDirty() {
+			t.Fatalf("Encode %d: frame 1 is still dirty", n)
+		}
+		b, err := s.read(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := decodeTestJPEG(t, b)
+		for i := 0; i < got.Size(); i++ {
+			if got.GetElement(i) != frames[1].GetElement(i) {
+				t.Fatalf("Encode %d: element %d is %d, expected %d", n, i, got.GetElement(i), frames[1].GetElement(i))
+			}
+		}
+	}
+
+	// Clean frames are left as extracted.
+	want := newTestJPEG(t, 0, 32, 16)
+	if b, _ := s.read(0); !bytes.Equal(b, want) {
+		t.Error("Clean frame 0 was rewritten")
+	}
+}
@@ -0,0 +1,236 @@
+package video
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// FrameStorage selects where the motion JPEG codec keeps the JPEG data of the
+// frames it extracts from a video.
+type FrameStorage int
+
+const (
+	// DiskFrames stores frames as plain JPEG files within the workspace.
+	DiskFrames FrameStorage = iota
+	// EncryptedFrames stores frames within the workspace, encrypted with a
+	// random key which is only ever held in memory.
+	EncryptedFrames
+	// MemoryFrames keeps frames in memory, nothing is written to disk.
+	MemoryFrames
+)
+
+var frameStorageNames = map[string]FrameStorage{
+	"disk":      DiskFrames,
+	"encrypted": EncryptedFrames,
+	"memory":    MemoryFrames,
+}
+
+// ParseFrameStorage returns the frame storage with the given name, one of
+// "disk", "encrypted" or "memory".
+func ParseFrameStorage(name string) (FrameStorage, error) {
+	s, ok := frameStorageNames[name]
+	if !ok {
+		return 0, fmt.Errorf("Unknown frame storage %q, use disk, encrypted or memory", name)
+	}
+	return s, nil
+}
+
+// frameStore holds the JPEG data of each frame of a video. Frames are written
+// in order when the video is decoded, and rewritten once modified.
+type frameStore interface {
+	// read returns the JPEG data of frame i.
+	read(i int) ([]byte, error)
+	// write sets the JPEG data of frame i, which is at most frames().
+	write(i int, b []byte) error
+	// frames returns the number of frames held.
+	frames() int
+	// wipe destroys the frames held in memory. Files are wiped along with the
+	// workspace.
+	wipe()
+}
+
+// newFrameStore returns an empty store of the given kind, keeping any files
+// within ws.
+func newFrameStore(storage FrameStorage, ws *workspace) (frameStore, error) {
+	switch storage {
+	case DiskFrames:
+		return &diskStore{ws: ws}, nil
+	case EncryptedFrames:
+		return newEncryptedStore(ws)
+	case MemoryFrames:
+		return &memoryStore{}, nil
+	}
+	return nil, fmt.Errorf("Unknown frame storage %d", storage)
+}
+
+// diskStore stores each frame as a JPEG file.
+type diskStore struct {
+	ws *workspace
+	n  int
+}
+
+func (s *diskStore) path(i int) string {
+	return s.ws.path(fmt.Sprintf("image-%d.jpeg", i))
+}
+
+func (s *diskStore) read(i int) ([]byte, error) {
+	return ioutil.ReadFile(s.path(i))
+}
+
+// write overwrites the previous frame in place, rather than truncating the
+// file first, so the blocks it held are not freed with the frame still in
+// them. A previous frame longer than b has the rest overwritten with random
+// data and synced before the file is truncated.
+func (s *diskStore) write(i int, b []byte) error {
+	f, err := os.OpenFile(s.path(i), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(b, 0); err != nil {
+		return err
+	}
+	if size := int64(len(b)); info.Size() > size {
+		tail := make([]byte, info.Size()-size)
+		if _, err := rand.Read(tail); err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(tail, size); err != nil {
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		if err := f.Truncate(size); err != nil {
+			return err
+		}
+	}
+	if i >= s.n {
+		s.n = i + 1
+	}
+	return f.Close()
+}
+
+func (s *diskStore) frames() int {
+	return s.n
+}
+
+func (s *diskStore) wipe() {}
+
+// encryptedStore stores each frame as a file encrypted with AES-256-GCM. The
+// key is generated when the store is created and is lost once the process
+// exits, after which the files cannot be read.
+type encryptedStore struct {
+	diskStore
+	aead cipher.AEAD
+}
+
+func newEncryptedStore(ws *workspace) (*encryptedStore, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("Failed to generate frame key: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	zero(key)
+	return &encryptedStore{diskStore: diskStore{ws: ws}, aead: aead}, nil
+}
+
+// Each file holds a random nonce followed by the sealed frame, with the frame
+// number as additional data so frames cannot be swapped.
+
+func (s *encryptedStore) read(i int) ([]byte, error) {
+	b, err := s.diskStore.read(i)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < s.aead.NonceSize() {
+		return nil, fmt.Errorf("Frame %d is truncated", i)
+	}
+	nonce, sealed := b[:s.aead.NonceSize()], b[s.aead.NonceSize():]
+	p, err := s.aead.Open(nil, nonce, sealed, frameNumber(i))
+	if err != nil {
+		return nil, fmt.Errorf("Frame %d failed to decrypt: %v", i, err)
+	}
+	return p, nil
+}
+
+func (s *encryptedStore) write(i int, b []byte) error {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(b)+s.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	return s.diskStore.write(i, s.aead.Seal(nonce, nonce, b, frameNumber(i)))
+}
+
+func (s *encryptedStore) wipe() {
+	s.aead = nil
+}
+
+func frameNumber(i int) []byte {
+	return []byte(fmt.Sprint(i))
+}
+
+// memoryStore keeps every frame in memory.
+type memoryStore struct {
+	data [][]byte
+}
+
+func (s *memoryStore) read(i int) ([]byte, error) {
+	if i >= len(s.data) {
+		return nil, fmt.Errorf("Frame %d does not exist", i)
+	}
+	return s.data[i], nil
+}
+
+func (s *memoryStore) write(i int, b []byte) error {
+	if i == len(s.data) {
+		s.data = append(s.data, nil)
+	}
+	if i > len(s.data) {
+		return fmt.Errorf("Frame %d does not exist", i)
+	}
+	// Overwrite the previous frame in place where possible so no copy of it
+	// remains in memory.
+	if cap(s.data[i]) >= len(b) {
+		old := s.data[i][:cap(s.data[i])]
+		copy(old, b)
+		zero(old[len(b):])
+		s.data[i] = old[:len(b)]
+	} else {
+		zero(s.data[i])
+		s.data[i] = append([]byte{}, b...)
+	}
+	return nil
+}
+
+func (s *memoryStore) frames() int {
+	return len(s.data)
+}
+
+func (s *memoryStore) wipe() {
+	for _, b := range s.data {
+		zero(b)
+	}
+	s.data = nil
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,175 @@
+package video
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// newTestStore returns an empty store of the given kind within a new
+// workspace, which is removed once t completes.
+func newTestStore(t *testing.T, storage FrameStorage) frameStore {
+	t.Setenv("TMPDIR", t.TempDir())
+	ws, err := newWorkspace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.remove() })
+	s, err := newFrameStore(storage, ws)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// TestFrameStores checks every kind of store reads back the frames written to
+// it, as they are rewritten longer and shorter.
+func TestFrameStores(t *testing.T) {
+	for name, storage := range frameStorageNames {
+		s := newTestStore(t, storage)
+		want := [][]byte{
+			bytes.Repeat([]byte{1}, 100),
+			bytes.Repeat([]byte{2}, 50),
+			bytes.Repeat([]byte{3}, 10),
+		}
+		for i, b := range want {
+			if err := s.write(i, b); err != nil {
+				t.Fatalf("%s: failed to write frame %d: %v", name, i, err)
+			}
+		}
+		want[0] = bytes.Repeat([]byte{4}, 20)
+		want[2] = bytes.Repeat([]byte{5}, 200)
+		for _, i := range []int{0, 2} {
+			if err := s.write(i, want[i]); err != nil {
+				t.Fatalf("%s: failed to rewrite frame %d: %v", name, i, err)
+			}
+		}
+
+		if s.frames() != len(want) {
+			t.Errorf("%s: holds %d frames, expected %d", name, s.frames(), len(want))
+		}
+		for i, b := range want {
+			got, err := s.read(i)
+			if err != nil {
+				t.Fatalf("%s: failed to read frame %d: %v", name, i, err)
+			}
+			if !bytes.Equal(got, b) {
+				t.Errorf("%s: frame %d is %d bytes, expected %d", name, i, len(got), len(b))
+			}
+		}
+		s.wipe()
+	}
+}
+
+// TestDiskStoreShrink checks a shorter frame overwrites the file of the
+// previous frame in place, leaving none of it behind.
+func TestDiskStoreShrink(t *testing.T) {
+	s := newTestStore(t, DiskFrames).(*diskStore)
+	if err := s.write(0, bytes.Repeat([]byte{1}, 4096)); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(s.path(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	short := bytes.Repeat([]byte{2}, 100)
+	if err := s.write(0, short); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(s.path(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Error("Frame was written to a new file")
+	}
+	if b, err := ioutil.ReadFile(s.path(0)); err != nil || !bytes.Equal(b, short) {
+		t.Errorf("File holds %d bytes, expected %d: %v", len(b), len(short), err)
+	}
+}
+
+// TestEncryptedStore checks frames are not written in the clear, and cannot be
+// read once swapped or truncated.
+func TestEncryptedStore(t *testing.T) {
+	s := newTestStore(t, EncryptedFrames).(*encryptedStore)
+	frame := bytes.Repeat([]byte("frame"), 100)
+	for i := 0; i < 2; i++ {
+		if err := s.write(i, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := ioutil.ReadFile(s.path(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("frame")) {
+		t.Error("Frame was written in the clear")
+	}
+
+	if err := ioutil.WriteFile(s.path(1), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.read(1); err == nil {
+		t.Error("Frame 0 was read as frame 1")
+	}
+	if err := ioutil.WriteFile(s.path(1), b[:s.aead.NonceSize()-1], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.read(1); err == nil {
+		t.Error("Truncated frame was read")
+	}
+
+	s.wipe()
+	if s.aead != nil {
+		t.Error("Frame key was not dropped")
+	}
+}
+
+// TestMemoryStore checks frames are overwritten in place and zeroed when
+// wiped, and that frames can only be appended.
+func TestMemoryStore(t *testing.T) {
+	s := &memoryStore{}
+	if err := s.write(1, []byte{1}); err == nil {
+		t.Error("Frame 1 was written to an empty store")
+	}
+	if err := s.write(0, bytes.Repeat([]byte{1}, 10)); err != nil {
+		t.Fatal(err)
+	}
+	old, err := s.read(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.write(0, []byte{2, 2, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{2, 2, 2, 0, 0, 0, 0, 0, 0, 0}; !bytes.Equal(old, want) {
+		t.Errorf("Previous frame holds %v, expected %v", old, want)
+	}
+
+	// A longer frame needs a new buffer, the previous one is zeroed.
+	old, _ = s.read(0)
+	long := bytes.Repeat([]byte{3}, 20)
+	if err := s.write(0, long); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(old, make([]byte, len(old))) {
+		t.Errorf("Previous frame holds %v, expected zeros", old)
+	}
+	long[0] = 4
+	if b, _ := s.read(0); b[0] != 3 {
+		t.Error("Store holds the caller's buffer")
+	}
+
+	old, _ = s.read(0)
+	s.wipe()
+	if !bytes.Equal(old, make([]byte, len(old))) {
+		t.Errorf("Wiped frame holds %v, expected zeros", old)
+	}
+	if s.frames() != 0 {
+		t.Errorf("Wiped store holds %d frames", s.frames())
+	}
+	if _, err := s.read(0); err == nil {
+		t.Error("Frame 0 was read from a wiped store")
+	}
+}
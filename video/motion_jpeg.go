@@ -1,168 +1,530 @@
 package video
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
-	"sync/atomic"
-	"time"
 
 	"stegasis/image/jpeg"
 )
 
+// defaultCachedFrames is the number of decoded frames held in memory unless
+// MotionJPEGCodecOptions.CachedFrames says otherwise.
+const defaultCachedFrames = 64
+
 // motionJPEGCodec uses FFMPEG to decode ~any video into a sequence of JPEG
 // images where we can embed data. motionJPEGCodec implements the Codec interface.
 type motionJPEGCodec struct {
 	filePath string
 	opts     MotionJPEGCodecOptions
-	frames   []*jpeg.JPEG
+	// ws holds the extracted frames and streams, nil until decoded.
+	ws *workspace
+	// store holds the JPEG data of each frame.
+	store frameStore
+	// cache holds the frames which have been decoded, frames are decoded as
+	// they are first used.
+	cache *frameCache
+	// frameRate is the frame rate of the source video, as given to FFMPEG.
+	frameRate string
+	// metadataPath is the FFMPEG metadata file holding the container metadata
+	// and chapters of the source video.
+	metadataPath string
+	// streamsPath holds the audio, subtitle and other non-video streams of
+	// the source video, empty if there are none.
+	streamsPath string
 }
 
 // MotionJPEGCodecOptions holds options for the motion jpect codec.
 type MotionJPEGCodecOptions struct {
-	// FrameRate of the input video.
+	// FrameRate of the input video, zero to read it from the video.
 	FrameRate int
+	// CachedFrames is the most unmodified frames held in memory at once, zero
+	// for a default.
+	CachedFrames int
+	// Storage is where the extracted frames are kept.
+	Storage FrameStorage
 }
 
-// Decode converts the source video file to a sequence of JPEG images via
-// FFMPEG and stores them in a tempory directory.
-func (c *motionJPEGCodec) Decode() error {
-	tempDir := fmt.Sprintf("%s\\stegasis", os.TempDir())
-	os.RemoveAll(tempDir)
-	if err := os.Mkdir(tempDir, 0777); err != nil {
-		return fmt.Errorf("Failed to create temp directory: %v", err)
+// probe returns the value of entry for each stream of the source video
+// selected by streams, or for all streams if streams is empty, as reported by
+// FFprobe.
+func (c *motionJPEGCodec) probe(streams, entry string) ([]string, error) {
+	args := []string{"-v", "error"}
+	if streams != "" {
+		args = append(args, "-select_streams", streams)
 	}
-	outputPattern := fmt.Sprintf("%s\\image-%%d.jpeg", tempDir)
+	args = append(args,
+		"-show_entries", "stream="+entry,
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		c.filePath,
+	)
+	out, err := exec.Command("ffprobe", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to exec ffprobe: %v", err)
+	}
+	return strings.Fields(string(out)), nil
+}
 
-	fmt.Printf("Extracting video frames from %q to: %q ...\n", c.filePath, outputPattern)
-	args := []string{
-		"-v", "quiet",
-		"-stats",
-		"-r", "25",
-		"-i", c.filePath,
-		"-qscale:v", "2",
-		"-f", "image2",
-		outputPattern,
+// probeVideo returns the value of entry for the first video stream of the
+// source video.
+func (c *motionJPEGCodec) probeVideo(entry string) (string, error) {
+	values, err := c.probe("v:0", entry)
+	if err != nil {
+		return "", err
 	}
-	cmd := exec.Command("ffmpeg", args...)
-	cmd.Stdout = os.Stdout
+	if len(values) == 0 {
+		return "", fmt.Errorf("No video stream found in %q", c.filePath)
+	}
+	return values[0], nil
+}
+
+// ffmpegCommand returns a command running FFMPEG with args, showing its
+// progress.
+func ffmpegCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command("ffmpeg", append([]string{"-v", "quiet", "-stats", "-y"}, args...)...)
 	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// ffmpeg runs FFMPEG with args.
+func ffmpeg(args ...string) error {
+	cmd := ffmpegCommand(args...)
+	cmd.Stdout = os.Stdout
 	if err := cmd.Run(); err != nil {
 		// TODO this doesn't actually give us a useful error message.
 		return fmt.Errorf("Failed to exec ffmpeg: %v", err)
 	}
-	fmt.Println("Successfully extracted video frames!")
+	return nil
+}
+
+// extractStreams copies everything but the video from the source video, so
+// Encode can put it back alongside the modified frames.
+func (c *motionJPEGCodec) extractStreams() error {
+	c.metadataPath = c.ws.path("metadata.txt")
+	if err := ffmpeg(c.metadataArgs()...); err != nil {
+		return fmt.Errorf("Failed to extract metadata: %v", err)
+	}
 
-	files, err := ioutil.ReadDir(tempDir)
+	indexes, err := c.probe("", "index")
+	if err != nil {
+		return err
+	}
+	types, err := c.probe("", "codec_type")
 	if err != nil {
-		return fmt.Errorf("Failed to read dir %q: %v", tempDir, err)
+		return err
+	}
+	streams, err := otherStreams(indexes, types)
+	if err != nil {
+		return fmt.Errorf("Failed to probe the streams of %q: %v", c.filePath, err)
+	}
+	c.streamsPath = ""
+	if len(streams) == 0 {
+		return nil
 	}
 
-	fmt.Println("Decoding frame data...")
-	now := time.Now()
-	var (
-		wg        sync.WaitGroup
-		mux       sync.Mutex
-		decodeErr error
-	)
+	// The streams are copied unchanged into the container of the source, as
+	// Encode writes, so every stream Encode can write back is kept. If the
+	// container cannot hold the streams on their own, such as a data stream
+	// which only the video refers to, each stream is tried by itself and
+	// those which cannot be copied are dropped.
+	path := c.ws.path("streams" + filepath.Ext(c.filePath))
+	if err := c.copyStreams(streams, path); err == nil {
+		c.streamsPath = path
+		return nil
+	}
+	var kept []string
+	for _, s := range streams {
+		if err := c.copyStreams([]string{s}, path); err != nil {
+			fmt.Printf("Warning: stream %s of %q cannot be copied and will be dropped when the video is written\n", s, c.filePath)
+			continue
+		}
+		kept = append(kept, s)
+	}
+	if len(kept) == 0 {
+		os.Remove(path)
+		return nil
+	}
+	if err := c.copyStreams(kept, path); err != nil {
+		return fmt.Errorf("Failed to extract streams: %v", err)
+	}
+	c.streamsPath = path
+	return nil
+}
 
-	total := int32(len(files))
-	c.frames = make([]*jpeg.JPEG, len(files))
-	sem := make(chan struct{}, 20)
-	for i, f := range files {
-		f := f
-		if i == 200 {
-			break
+// otherStreams returns the indexes of the streams which are not video, given
+// the index and type of every stream as reported by FFprobe.
+func otherStreams(indexes, types []string) ([]string, error) {
+	if len(indexes) != len(types) {
+		return nil, fmt.Errorf("%d stream indexes for %d stream types", len(indexes), len(types))
+	}
+	var streams []string
+	for i, t := range types {
+		if t != "video" {
+			streams = append(streams, indexes[i])
 		}
-		sem <- struct{}{}
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
+	}
+	return streams, nil
+}
 
-			jpegPath := tempDir + "\\" + f.Name()
-			r, err := os.Open(jpegPath)
-			if err != nil {
-				decodeErr = fmt.Errorf("Failed to read file %q: %v", f.Name(), err)
-				return
-			}
+// metadataArgs returns the FFMPEG arguments which write the container metadata
+// and chapters of the source video to metadataPath.
+func (c *motionJPEGCodec) metadataArgs() []string {
+	return []string{"-i", c.filePath, "-f", "ffmetadata", c.metadataPath}
+}
 
-			j, err := jpeg.DecodeJPEG(r, jpegPath)
-			if err != nil {
-				decodeErr = fmt.Errorf("Failed to decode JPEG %q: %v", f.Name(), err)
-				return
-			}
+// copyStreams copies the streams of the source video with the given indexes,
+// unchanged, to a new file at path.
+func (c *motionJPEGCodec) copyStreams(streams []string, path string) error {
+	return ffmpeg(c.copyArgs(streams, path)...)
+}
 
-			index := strings.Split(strings.Split(f.Name(), ".")[0], "-")[1]
-			i, err := strconv.Atoi(index)
-			if err != nil {
-				decodeErr = fmt.Errorf("Could not extract index from filename %q: %v", f.Name(), err)
-				return
-			}
+// copyArgs returns the FFMPEG arguments used by copyStreams.
+func (c *motionJPEGCodec) copyArgs(streams []string, path string) []string {
+	args := []string{"-i", c.filePath}
+	for _, s := range streams {
+		args = append(args, "-map", "0:"+s)
+	}
+	return append(args, "-c", "copy", "-copy_unknown", path)
+}
 
-			mux.Lock()
-			c.frames[i] = j
-			mux.Unlock()
+// Decode converts the source video file to a sequence of JPEG images via
+// FFMPEG and keeps them as given by MotionJPEGCodecOptions.Storage. Frames are
+// read from FFMPEG through a pipe so they only reach the disk if stored there.
+// Videos which are already motion JPEG, such as those previously written by
+// Encode, have their frames copied out bit-exact so previously embedded data
+// survives.
+func (c *motionJPEGCodec) Decode() error {
+	codecName, err := c.probeVideo("codec_name")
+	if err != nil {
+		return err
+	}
+	c.frameRate = strconv.Itoa(c.opts.FrameRate)
+	if c.opts.FrameRate == 0 {
+		if c.frameRate, err = c.probeVideo("r_frame_rate"); err != nil {
+			return err
+		}
+	}
 
-			atomic.AddInt32(&total, -1)
-			if total%50 == 0 {
-				fmt.Printf("Frames left: %d\n", total)
-			}
-			<-sem
-		}()
+	c.Close()
+	if c.ws, err = newWorkspace(); err != nil {
+		return err
+	}
+	if c.store, err = newFrameStore(c.opts.Storage, c.ws); err != nil {
+		return err
+	}
+	if err := c.extractStreams(); err != nil {
+		return err
 	}
-	wg.Wait()
 
-	if decodeErr != nil {
-		return decodeErr
+	fmt.Printf("Extracting video frames from %q ...\n", c.filePath)
+	args := []string{
+		"-r", c.frameRate,
+		"-i", c.filePath,
+		"-map", "0:v:0",
+	}
+	if codecName == "mjpeg" {
+		args = append(args, "-c:v", "copy")
+	} else {
+		args = append(args, "-qscale:v", "2")
 	}
+	args = append(args, "-f", "image2pipe", "pipe:1")
+	if err := c.extractFrames(ffmpegCommand(args...)); err != nil {
+		return err
+	}
+	fmt.Printf("Successfully extracted %d video frames!\n", c.store.frames())
 
-	fmt.Printf("Finished decoding frame data. Took: %s\n", time.Since(now))
+	capacity := c.opts.CachedFrames
+	if capacity <= 0 {
+		capacity = defaultCachedFrames
+	}
+	c.cache = newFrameCache(capacity, c.store)
+	if c.Frames() > 0 {
+		// Decode the first frame now so unreadable frames are reported early.
+		if _, err := c.frame(0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	err = c.frames[111].Encode()
+// extractFrames runs cmd, which writes a sequence of JPEG images to its
+// standard output, storing each image as the next frame.
+func (c *motionJPEGCodec) extractFrames(cmd *exec.Cmd) error {
+	out, err := cmd.StdoutPipe()
 	if err != nil {
-		fmt.Printf("err: %v\n", err)
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Failed to exec ffmpeg: %v", err)
+	}
+	r := bufio.NewReader(out)
+	for i := 0; ; i++ {
+		b, err := readJPEG(r)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = c.store.write(i, b)
+		}
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return fmt.Errorf("Failed to extract frame %d: %v", i, err)
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("Failed to exec ffmpeg: %v", err)
 	}
 	return nil
 }
 
-// Encode converts the sequence of JPEG images to a motion JPEG video
-// overwriting the original source video.
-func (c *motionJPEGCodec) Encode() error {
-	for i, f := range c.frames {
-		if f.IsDirty() {
-			err := f.Encode()
-			if err != nil {
-				return fmt.Errorf("Failed to encode frame %d: %v", i, err)
+// readJPEG reads the next JPEG image from r. Returns io.EOF if r holds no more
+// images.
+func readJPEG(r *bufio.Reader) ([]byte, error) {
+	var b bytes.Buffer
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(r, soi); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("Truncated JPEG")
+		}
+		return nil, err
+	}
+	if soi[0] != 0xff || soi[1] != 0xd8 {
+		return nil, fmt.Errorf("Missing JPEG start of image marker")
+	}
+	b.Write(soi)
+
+	marker, err := nextMarker(r, &b, false)
+	for ; err == nil; marker, err = nextMarker(r, &b, marker == 0xda) {
+		switch {
+		case marker == 0xd9:
+			// End of image.
+			return b.Bytes(), nil
+		case marker == 0x01 || marker >= 0xd0 && marker <= 0xd7:
+			// Markers without a segment.
+			continue
+		}
+		length := make([]byte, 2)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return nil, fmt.Errorf("Truncated JPEG")
+		}
+		b.Write(length)
+		n := int64(length[0])<<8 | int64(length[1])
+		if n < 2 {
+			return nil, fmt.Errorf("Invalid JPEG segment length %d", n)
+		}
+		if _, err := io.CopyN(&b, r, n-2); err != nil {
+			return nil, fmt.Errorf("Truncated JPEG")
+		}
+	}
+	if err == io.EOF {
+		err = fmt.Errorf("Truncated JPEG")
+	}
+	return nil, err
+}
+
+// nextMarker copies bytes from r to b up to and including the next marker,
+// returning the marker. If scan is true the bytes are entropy coded data, in
+// which 0xff is followed by 0x00 or a restart marker, otherwise a marker must
+// follow immediately.
+func nextMarker(r *bufio.Reader, b *bytes.Buffer, scan bool) (byte, error) {
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		b.WriteByte(c)
+		if c != 0xff {
+			if !scan {
+				return 0, fmt.Errorf("Missing JPEG marker")
+			}
+			continue
+		}
+		// Any number of 0xff fill bytes may precede a marker.
+		for c == 0xff {
+			if c, err = r.ReadByte(); err != nil {
+				return 0, err
 			}
+			b.WriteByte(c)
 		}
+		if scan && (c == 0x00 || c >= 0xd0 && c <= 0xd7) {
+			continue
+		}
+		return c, nil
+	}
+}
+
+// frame returns frame i, decoding it if it is not cached.
+func (c *motionJPEGCodec) frame(i int) (*jpeg.JPEG, error) {
+	if j := c.cache.get(i); j != nil {
+		return j, nil
+	}
+	b, err := c.store.read(i)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read frame %d: %v", i, err)
+	}
+	j, err := jpeg.DecodeJPEG(bytes.NewReader(b), "")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode frame %d: %v", i, err)
+	}
+	return j, c.cache.add(i, j)
+}
+
+// cachedFrame is a frame of a motionJPEGCodec. Modifying the frame returns it
+// to the cache, so it is encoded even if it was evicted while in use.
+type cachedFrame struct {
+	*jpeg.JPEG
+	codec *motionJPEGCodec
+	i     int
+}
+
+// SetElement sets the ith element to val. Dirty frames are always cached, so
+// only the first modification needs to check. The frame is returned to the
+// cache without evicting others, which may fail, the cache is brought back
+// within its capacity by the next frame decoded.
+func (f *cachedFrame) SetElement(i, val int) {
+	dirty := f.IsDirty()
+	f.JPEG.SetElement(i, val)
+	if !dirty && f.codec.cache.get(f.i) != f.JPEG {
+		f.codec.cache.put(f.i, f.JPEG)
+	}
+}
+
+// Encode converts the sequence of JPEG images to a motion JPEG video
+// overwriting the original source video. The JPEG images are copied into the
+// video unchanged, at the frame rate of the source video, along with the other
+// streams, chapters and metadata of the source video. The video is written
+// alongside the source and renamed over it so the source is never left
+// partially written.
+func (c *motionJPEGCodec) Encode() error {
+	if err := c.cache.encode(); err != nil {
+		return err
 	}
 
-	// TODO call FFMPEG to re-assemble the frames into a mjpeg.
+	// The temporary file keeps the extension of the source so FFMPEG writes
+	// the same container format.
+	tempPath := filepath.Join(filepath.Dir(c.filePath), ".stegasis-"+filepath.Base(c.filePath))
+	fmt.Printf("Writing video frames to %q ...\n", c.filePath)
+	if err := c.muxFrames(ffmpegCommand(c.muxArgs(tempPath)...)); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	if err := os.Rename(tempPath, c.filePath); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("Failed to replace %q: %v", c.filePath, err)
+	}
+	fmt.Println("Successfully wrote video frames!")
 	return nil
 }
 
-// GetFrame returns the ith frame. Panics if i >= Frames() or i < 0.
-func (c *motionJPEGCodec) GetFrame(i int) Frame {
+// muxArgs returns the FFMPEG arguments which write the JPEG images piped to its
+// standard input to a video at path, copied unchanged at the frame rate of the
+// source video, along with the streams, chapters and metadata extracted from
+// the source video.
+func (c *motionJPEGCodec) muxArgs(path string) []string {
+	args := []string{
+		"-f", "image2pipe",
+		"-framerate", c.frameRate,
+		"-i", "pipe:0",
+		"-i", c.metadataPath,
+	}
+	if c.streamsPath != "" {
+		args = append(args, "-i", c.streamsPath)
+	}
+	args = append(args, "-map", "0:v")
+	if c.streamsPath != "" {
+		args = append(args, "-map", "2")
+	}
+	return append(args,
+		"-map_metadata", "1",
+		"-map_chapters", "1",
+		"-c", "copy",
+		path,
+	)
+}
+
+// AtomicEncode implements AtomicEncoder, Encode renames the new video over the
+// source.
+func (c *motionJPEGCodec) AtomicEncode() bool {
+	return true
+}
+
+// muxFrames runs cmd, writing every frame to its standard input.
+func (c *motionJPEGCodec) muxFrames(cmd *exec.Cmd) error {
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = os.Stdout
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Failed to exec ffmpeg: %v", err)
+	}
+	for i := 0; i < c.Frames() && err == nil; i++ {
+		var b []byte
+		if b, err = c.store.read(i); err == nil {
+			_, err = in.Write(b)
+		}
+		if err != nil {
+			err = fmt.Errorf("Failed to write frame %d: %v", i, err)
+		}
+	}
+	in.Close()
+	if waitErr := cmd.Wait(); err == nil && waitErr != nil {
+		err = fmt.Errorf("Failed to exec ffmpeg: %v", waitErr)
+	}
+	return err
+}
+
+// GetFrame returns the ith frame, decoding it if it is not cached. Panics if
+// i >= Frames() or i < 0.
+func (c *motionJPEGCodec) GetFrame(i int) (Frame, error) {
 	if i < 0 {
 		panic(fmt.Errorf("GetFrame %d cannot be negative", i))
 	}
 	if i >= c.Frames() {
 		panic(fmt.Errorf("GetFrame %d is larger than total frame count %d", i, c.Frames()))
 	}
-	return c.frames[i]
+	j, err := c.frame(i)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedFrame{j, c, i}, nil
+}
+
+// ElementType implements Codec, the frames hold DCT coefficients.
+func (c *motionJPEGCodec) ElementType() ElementType {
+	return DCTCoefficients
 }
 
 // Frames returns the number of frames within the video file.
 func (c *motionJPEGCodec) Frames() int {
-	return len(c.frames)
+	if c.store == nil {
+		return 0
+	}
+	return c.store.frames()
 }
 
-// Close closes the motion JPEG codec.
+// Close closes the motion JPEG codec, wiping the frames it holds and its
+// workspace. Modified frames not yet written back by Encode are lost.
 func (c *motionJPEGCodec) Close() {
+	if c.store != nil {
+		c.store.wipe()
+		c.store = nil
+	}
+	c.cache = nil
+	if c.ws == nil {
+		return
+	}
+	if err := c.ws.remove(); err != nil {
+		fmt.Printf("%v\n", err)
+	}
+	c.ws = nil
 }
 
 // NewMotionJPEGCodec returns a new motion JPEG codec.
@@ -0,0 +1,344 @@
+package video
+
+import (
+	"bufio"
+	"bytes"
+	"image"
+	"image/color"
+	stdjpeg "image/jpeg"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"stegasis/image/jpeg"
+)
+
+// newTestJPEG returns a w by h pixel JPEG of random noise, encoded in 4:2:0 as
+// FFMPEG produces them. The same seed always gives the same JPEG.
+func newTestJPEG(t *testing.T, seed int64, w, h int) []byte {
+	r := rand.New(rand.NewSource(seed))
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(r.Intn(256)), uint8(r.Intn(256)), uint8(r.Intn(256)), 255})
+		}
+	}
+	var b bytes.Buffer
+	if err := stdjpeg.Encode(&b, img, &stdjpeg.Options{Quality: 100}); err != nil {
+		t.Fatalf("Failed to encode test JPEG: %v", err)
+	}
+	// The decoder only holds one quantization table, drop the chrominance
+	// table. At quality 100 both tables are all ones anyway.
+	data := b.Bytes()
+	if data[2] != 0xff || data[3] != 0xdb || data[4] != 0 || data[5] != 2+2*65 {
+		t.Fatalf("Unexpected test JPEG layout % x", data[:6])
+	}
+	data[5] = 2 + 65
+	return append(data[:6+65], data[6+2*65:]...)
+}
+
+// decodeTestJPEG fails t unless b decodes.
+func decodeTestJPEG(t *testing.T, b []byte) *jpeg.JPEG {
+	j, err := jpeg.DecodeJPEG(bytes.NewReader(b), "")
+	if err != nil {
+		t.Fatalf("Failed to decode JPEG: %v", err)
+	}
+	return j
+}
+
+// TestReadJPEG checks a stream of JPEG images is split back into the same
+// images, whatever markers and fill bytes they hold.
+func TestReadJPEG(t *testing.T) {
+	var images [][]byte
+	for seed := int64(0); seed < 4; seed++ {
+		images = append(images, newTestJPEG(t, seed, 48, 32))
+	}
+	stuffed := false
+	for _, b := range images {
+		stuffed = stuffed || bytes.Contains(b, []byte{0xff, 0x00})
+	}
+	if !stuffed {
+		t.Fatal("No test JPEG holds a stuffed 0xff byte")
+	}
+
+	// A comment segment after the start of image, fill bytes before a marker
+	// and a restart marker within the entropy coded data.
+	com := []byte{0xff, 0xfe, 0x00, 0x05, 0xff, 0xd9, 0x00}
+	images[1] = append(append(append([]byte{}, images[1][:2]...), com...), images[1][2:]...)
+	images[2] = append(append([]byte{}, images[2][:2]...), append([]byte{0xff, 0xff}, images[2][2:]...)...)
+	n := len(images[3]) - 2
+	images[3] = append(append(append([]byte{}, images[3][:n]...), 0xff, 0xd0, 0x12), images[3][n:]...)
+
+	var stream []byte
+	for _, b := range images {
+		stream = append(stream, b...)
+	}
+	r := bufio.NewReader(bytes.NewReader(stream))
+	for i, want := range images {
+		got, err := readJPEG(r)
+		if err != nil {
+			t.Fatalf("Image %d: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("Image %d is %d bytes, expected %d", i, len(got), len(want))
+		}
+	}
+	if _, err := readJPEG(r); err != io.EOF {
+		t.Fatalf("Expected io.EOF after the last image, got %v", err)
+	}
+	decodeTestJPEG(t, images[0])
+}
+
+func TestReadJPEGInvalid(t *testing.T) {
+	b := newTestJPEG(t, 0, 16, 16)
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"truncated start of image", b[:1]},
+		{"missing start of image", b[2:]},
+		{"truncated segment", b[:10]},
+		{"truncated scan", b[:len(b)-2]},
+		{"missing marker", append([]byte{0xff, 0xd8, 0x00}, b[2:]...)},
+		{"invalid segment length", []byte{0xff, 0xd8, 0xff, 0xfe, 0x00, 0x01}},
+	} {
+		if _, err := readJPEG(bufio.NewReader(bytes.NewReader(tc.data))); err == nil || err == io.EOF {
+			t.Errorf("%s: expected an error, got %v", tc.name, err)
+		}
+	}
+}
+
+// TestCachedFrameEvicted checks a frame modified after it was evicted from the
+// cache is returned to it, and encoded.
+func TestCachedFrameEvicted(t *testing.T) {
+	s := &memoryStore{}
+	for i := 0; i < 3; i++ {
+		if err := s.write(i, newTestJPEG(t, int64(i), 32, 32)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := &motionJPEGCodec{store: s, cache: newFrameCache(1, s)}
+
+	f, err := c.GetFrame(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 3; i++ {
+		if _, err := c.GetFrame(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.cache.get(0) != nil {
+		t.Fatal("Frame 0 was not evicted")
+	}
+
+	f.SetElement(5, f.GetElement(5)+1)
+	f.SetElement(6, f.GetElement(6)+1)
+	if c.cache.lru.Len() != 2 {
+		t.Fatalf("Cache holds %d frames, expected 2", c.cache.lru.Len())
+	}
+	if err := c.cache.encode(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.read(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := decodeTestJPEG(t, b)
+	for _, i := range []int{5, 6} {
+		if got.GetElement(i) != f.GetElement(i) {
+			t.Errorf("Element %d is %d, expected %d", i, got.GetElement(i), f.GetElement(i))
+		}
+	}
+
+	// The next frame decoded brings the cache back within its capacity.
+	if _, err := c.GetFrame(1); err != nil {
+		t.Fatal(err)
+	}
+	if c.cache.lru.Len() != 1 {
+		t.Fatalf("Cache holds %d frames, expected 1", c.cache.lru.Len())
+	}
+}
+
+// requireFFmpeg skips t unless FFMPEG and FFprobe are installed.
+func requireFFmpeg(t *testing.T) {
+	for _, name := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s is not installed", name)
+		}
+	}
+}
+
+// newTestVideo runs FFMPEG with args to write a video to path.
+func newTestVideo(t *testing.T, path string, args ...string) {
+	args = append(append([]string{"-v", "error", "-y"}, args...), path)
+	if out, err := exec.Command("ffmpeg", args...).CombinedOutput(); err != nil {
+		t.Fatalf("Failed to write test video: %v\n%s", err, out)
+	}
+}
+
+func TestMuxArgs(t *testing.T) {
+	c := &motionJPEGCodec{frameRate: "30000/1001", metadataPath: "metadata.txt"}
+	want := []string{
+		"-f", "image2pipe", "-framerate", "30000/1001", "-i", "pipe:0",
+		"-i", "metadata.txt",
+		"-map", "0:v",
+		"-map_metadata", "1", "-map_chapters", "1", "-c", "copy", "out.mkv",
+	}
+	if got := c.muxArgs("out.mkv"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Without streams got %q, expected %q", got, want)
+	}
+
+	c.streamsPath = "streams.mkv"
+	want = []string{
+		"-f", "image2pipe", "-framerate", "30000/1001", "-i", "pipe:0",
+		"-i", "metadata.txt", "-i", "streams.mkv",
+		"-map", "0:v", "-map", "2",
+		"-map_metadata", "1", "-map_chapters", "1", "-c", "copy", "out.mkv",
+	}
+	if got := c.muxArgs("out.mkv"); !reflect.DeepEqual(got, want) {
+		t.Errorf("With streams got %q, expected %q", got, want)
+	}
+}
+
+// TestEncode modifies a frame of a motion JPEG video and checks the
+// modification is read back once the video is encoded and decoded again.
+func TestEncode(t *testing.T) {
+	requireFFmpeg(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "video.avi")
+	newTestVideo(t, path, "-f", "lavfi", "-i", "testsrc=size=64x48:rate=10:duration=1", "-c:v", "mjpeg")
+
+	opts := MotionJPEGCodecOptions{Storage: MemoryFrames}
+	c := NewMotionJPEGCodec(path, opts)
+	if err := c.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	n := c.Frames()
+	if n != 10 {
+		t.Fatalf("Decoded %d frames, expected 10", n)
+	}
+	f, err := c.GetFrame(n / 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An AC coefficient of the first block.
+	const j = 9
+	want := f.GetElement(j) + 1
+	f.SetElement(j, want)
+	if err := c.Encode(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if temp, _ := filepath.Glob(filepath.Join(dir, ".stegasis-*")); len(temp) != 0 {
+		t.Errorf("Encode left %q behind", temp)
+	}
+
+	c = NewMotionJPEGCodec(path, opts)
+	defer c.Close()
+	if err := c.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Frames() != n {
+		t.Fatalf("Decoded %d frames after encoding, expected %d", c.Frames(), n)
+	}
+	if f, err = c.GetFrame(n / 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.GetElement(j); got != want {
+		t.Fatalf("Element %d is %d after encoding, expected %d", j, got, want)
+	}
+}
+
+func TestExtractArgs(t *testing.T) {
+	c := &motionJPEGCodec{filePath: "in.mkv", metadataPath: "metadata.txt"}
+	want := []string{"-i", "in.mkv", "-f", "ffmetadata", "metadata.txt"}
+	if got := c.metadataArgs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Metadata got %q, expected %q", got, want)
+	}
+	want = []string{"-i", "in.mkv", "-map", "0:1", "-map", "0:3", "-c", "copy", "-copy_unknown", "streams.mkv"}
+	if got := c.copyArgs([]string{"1", "3"}, "streams.mkv"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Streams got %q, expected %q", got, want)
+	}
+
+	streams, err := otherStreams([]string{"0", "1", "2", "3"}, []string{"video", "audio", "video", "subtitle"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1", "3"}; !reflect.DeepEqual(streams, want) {
+		t.Errorf("Other streams got %q, expected %q", streams, want)
+	}
+	if _, err := otherStreams([]string{"0"}, nil); err == nil {
+		t.Error("Mismatched stream indexes and types did not fail")
+	}
+}
+
+// ffprobeTest returns the output of FFprobe run on path with args, one value
+// per line.
+func ffprobeTest(t *testing.T, path string, args ...string) []string {
+	args = append(append([]string{"-v", "error"}, args...), path)
+	out, err := exec.Command("ffprobe", args...).Output()
+	if err != nil {
+		t.Fatalf("Failed to probe %q: %v", path, err)
+	}
+	return strings.Fields(string(out))
+}
+
+// TestEncodeStreams checks the audio and subtitle streams, metadata and
+// chapters of a video survive it being decoded and encoded.
+func TestEncodeStreams(t *testing.T) {
+	requireFFmpeg(t)
+	dir := t.TempDir()
+	subs := filepath.Join(dir, "subs.srt")
+	if err := os.WriteFile(subs, []byte("1\n00:00:00,000 --> 00:00:00,500\nhello\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	meta := filepath.Join(dir, "metadata.txt")
+	chapters := ";FFMETADATA1\ntitle=stegasis\n[CHAPTER]\nTIMEBASE=1/1000\nSTART=0\nEND=500\ntitle=first\n"
+	if err := os.WriteFile(meta, []byte(chapters), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "video.mkv")
+	newTestVideo(t, path,
+		"-f", "lavfi", "-i", "testsrc=size=64x48:rate=10:duration=1",
+		"-f", "lavfi", "-i", "sine=duration=1",
+		"-i", subs,
+		"-i", meta,
+		"-map", "0", "-map", "1", "-map", "2",
+		"-map_metadata", "3", "-map_chapters", "3",
+		"-c:v", "mjpeg", "-c:a", "flac", "-c:s", "srt",
+	)
+
+	c := NewMotionJPEGCodec(path, MotionJPEGCodecOptions{Storage: MemoryFrames})
+	if err := c.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := c.GetFrame(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.SetElement(9, f.GetElement(9)+1)
+	if err := c.Encode(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	for _, tc := range []struct {
+		entries string
+		want    []string
+	}{
+		{"stream=codec_type", []string{"video", "audio", "subtitle"}},
+		{"format_tags=title", []string{"stegasis"}},
+		{"chapter_tags=title", []string{"first"}},
+	} {
+		got := ffprobeTest(t, path, "-show_entries", tc.entries, "-of", "default=noprint_wrappers=1:nokey=1")
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s is %q after encoding, expected %q", tc.entries, got, tc.want)
+		}
+	}
+}
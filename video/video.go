@@ -1,6 +1,8 @@
 // Package video provides video decode and encoding functionaltiy.
 package video
 
+import "fmt"
+
 // Codec defines the interface for a video codec. That is, providing access to
 // individual frames so we can steganographically embed data within them.
 type Codec interface {
@@ -10,8 +12,13 @@ type Codec interface {
 	// Encode writes back any modified frames into the source video file. This
 	// can be called multiple times during the lifetime of the Codec.
 	Encode() error
-	// GetFrame returns the ith frame. Panics if i >= Frames() or i < 0.
-	GetFrame(i int) Frame
+	// GetFrame returns the ith frame, or an error if the frame could not be
+	// loaded. Panics if i >= Frames() or i < 0.
+	GetFrame(i int) (Frame, error)
+	// Frames returns the number of frames within the video.
+	Frames() int
+	// ElementType returns the type of the elements of every frame.
+	ElementType() ElementType
 	// Close closes the Codec.
 	Close()
 }
@@ -30,3 +37,38 @@ type Frame interface {
 	// IsDirty returns true iff the frame is considered dirty.
 	IsDirty() bool
 }
+
+// ElementType is the type of value held by the elements of a frame, which
+// decides the embedding algorithms the frame can be used with.
+type ElementType int
+
+const (
+	// Pixels are the individual channel bytes of uncompressed pixels.
+	Pixels ElementType = iota
+	// DCTCoefficients are the quantized DCT coefficients of a JPEG, as
+	// consecutive 8x8 blocks with the DC coefficient first.
+	DCTCoefficients
+)
+
+func (t ElementType) String() string {
+	switch t {
+	case Pixels:
+		return "uncompressed pixels"
+	case DCTCoefficients:
+		return "DCT coefficients"
+	}
+	return fmt.Sprintf("ElementType(%d)", int(t))
+}
+
+// AtomicEncoder is implemented by codecs whose Encode replaces the whole video
+// at once, so an interrupted Encode leaves the video as it was before.
+type AtomicEncoder interface {
+	// AtomicEncode returns true iff Encode is atomic.
+	AtomicEncode() bool
+}
+
+// IsAtomic returns true iff Encode of c is atomic.
+func IsAtomic(c Codec) bool {
+	a, ok := c.(AtomicEncoder)
+	return ok && a.AtomicEncode()
+}
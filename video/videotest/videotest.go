@@ -0,0 +1,130 @@
+// Package videotest provides in memory frames and codecs for testing the
+// packages built on video.
+package videotest
+
+import (
+	"math/rand"
+
+	"stegasis/video"
+)
+
+// dctBlockSize is the number of DCT coefficients in a block, the first of which
+// is the DC coefficient.
+const dctBlockSize = 64
+
+// Frame is an in memory video.Frame.
+type Frame struct {
+	// Elems holds the elements of the frame.
+	Elems []int
+	dirty bool
+}
+
+// NewFrame returns a frame of size elements of type typ drawn from r. Pixels
+// are uniformly random bytes, DCT coefficients are as given by NewDCTFrame with
+// a standard deviation of 6.
+func NewFrame(r *rand.Rand, typ video.ElementType, size int) *Frame {
+	if typ == video.DCTCoefficients {
+		return NewDCTFrame(r, size, 6)
+	}
+	f := &Frame{Elems: make([]int, size)}
+	for j := range f.Elems {
+		f.Elems[j] = r.Intn(256)
+	}
+	return f
+}
+
+// NewDCTFrame returns a frame of size DCT coefficients drawn from r, laid out
+// in 8x8 blocks as jpeg.JPEG exposes them. AC coefficients are drawn from a
+// Gaussian distribution with standard deviation sigma, roughly as found in a
+// JPEG.
+func NewDCTFrame(r *rand.Rand, size int, sigma float64) *Frame {
+	f := &Frame{Elems: make([]int, size)}
+	for j := range f.Elems {
+		if j%dctBlockSize == 0 {
+			f.Elems[j] = r.Intn(2048) - 1024
+		} else {
+			f.Elems[j] = int(r.NormFloat64() * sigma)
+		}
+	}
+	return f
+}
+
+// Size returns the number of elements in the frame.
+func (f *Frame) Size() int {
+	return len(f.Elems)
+}
+
+// GetElement returns the ith element.
+func (f *Frame) GetElement(i int) int {
+	return f.Elems[i]
+}
+
+// SetElement sets the ith element to val.
+func (f *Frame) SetElement(i, val int) {
+	f.Elems[i] = val
+	f.dirty = true
+}
+
+// IsDirty returns true if the frame has been modified.
+func (f *Frame) IsDirty() bool {
+	return f.dirty
+}
+
+// Codec is an in memory video.Codec. Encode only marks every frame clean.
+type Codec struct {
+	// Type is the element type the frames of the codec are reported to hold.
+	Type   video.ElementType
+	frames []*Frame
+}
+
+// NewCodec returns a codec of frames made by NewFrame, frame i holding sizes[i]
+// elements of type typ. The same seed always gives the same codec.
+func NewCodec(seed int64, typ video.ElementType, sizes ...int) *Codec {
+	r := rand.New(rand.NewSource(seed))
+	c := &Codec{Type: typ}
+	for _, size := range sizes {
+		c.frames = append(c.frames, NewFrame(r, typ, size))
+	}
+	return c
+}
+
+// Sizes returns n copies of size, the sizes of a codec of n equal frames.
+func Sizes(n, size int) []int {
+	sizes := make([]int, n)
+	for i := range sizes {
+		sizes[i] = size
+	}
+	return sizes
+}
+
+// Decode does nothing, the frames are already in memory.
+func (c *Codec) Decode() error {
+	return nil
+}
+
+// Encode marks every frame clean.
+func (c *Codec) Encode() error {
+	for _, f := range c.frames {
+		f.dirty = false
+	}
+	return nil
+}
+
+// GetFrame returns the ith frame.
+func (c *Codec) GetFrame(i int) (video.Frame, error) {
+	return c.frames[i], nil
+}
+
+// Frames returns the number of frames.
+func (c *Codec) Frames() int {
+	return len(c.frames)
+}
+
+// ElementType returns Type.
+func (c *Codec) ElementType() video.ElementType {
+	return c.Type
+}
+
+// Close does nothing.
+func (c *Codec) Close() {
+}
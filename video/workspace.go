@@ -0,0 +1,152 @@
+package video
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// workspacePrefix starts the name of every workspace directory.
+	workspacePrefix = "stegasis-"
+	// lockName is the name of the file marking a workspace as in use, it holds
+	// the pid of the process using the workspace.
+	lockName = "stegasis.lock"
+)
+
+// workspace is a private directory holding the intermediate files of a codec.
+// Each codec has its own uniquely named workspace so any number of videos can
+// be decoded at once.
+type workspace struct {
+	dir string
+}
+
+// newWorkspace creates and locks a new workspace within the system temporary
+// directory. Workspaces left behind by processes which have since died, which
+// may hold the frames of a video, are removed first.
+func newWorkspace() (*workspace, error) {
+	removeStaleWorkspaces()
+	dir, err := ioutil.TempDir("", workspacePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create workspace: %v", err)
+	}
+	w := &workspace{dir: dir}
+	if err := w.lock(); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return w, nil
+}
+
+// lock marks the workspace as in use by this process. Fails if the workspace
+// is already locked.
+func (w *workspace) lock() error {
+	f, err := os.OpenFile(w.path(lockName), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to lock workspace %q: %v", w.dir, err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%d\n", os.Getpid()); err != nil {
+		return fmt.Errorf("Failed to lock workspace %q: %v", w.dir, err)
+	}
+	return nil
+}
+
+// owner returns the pid of the process which locked the workspace.
+func (w *workspace) owner() (int, error) {
+	b, err := ioutil.ReadFile(w.path(lockName))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// inUse returns true iff the workspace is locked by a process other than this
+// one which is still running.
+func (w *workspace) inUse() bool {
+	pid, err := w.owner()
+	return err == nil && pid != os.Getpid() && processAlive(pid)
+}
+
+// processAlive returns true iff the process with the given pid is running.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return !errors.Is(p.Signal(syscall.Signal(0)), os.ErrProcessDone)
+}
+
+// removeStaleWorkspaces removes the workspaces within the system temporary
+// directory whose process is no longer running. Workspaces of this process
+// belong to codecs which are still open.
+func removeStaleWorkspaces() {
+	dirs, err := filepath.Glob(filepath.Join(os.TempDir(), workspacePrefix+"*"))
+	if err != nil {
+		return
+	}
+	for _, dir := range dirs {
+		// A workspace which is not yet locked may be about to be locked by the
+		// process which created it.
+		w := &workspace{dir: dir}
+		pid, err := w.owner()
+		if err != nil || pid == os.Getpid() || processAlive(pid) {
+			continue
+		}
+		fmt.Printf("Removing workspace %q left by a previous run\n", dir)
+		if err := w.remove(); err != nil {
+			fmt.Printf("%v\n", err)
+		}
+	}
+}
+
+// path returns the path of the file name within the workspace.
+func (w *workspace) path(name string) string {
+	return filepath.Join(w.dir, name)
+}
+
+// remove overwrites every file within the workspace and then deletes the
+// workspace. Overwriting is best effort, filesystems which copy on write or
+// storage which remaps blocks may still hold the previous contents. Fails if
+// the workspace is in use by another process.
+func (w *workspace) remove() error {
+	if w.inUse() {
+		return fmt.Errorf("Workspace %q is in use by another process", w.dir)
+	}
+	files, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		return fmt.Errorf("Failed to read workspace %q: %v", w.dir, err)
+	}
+	for _, f := range files {
+		if f.Mode().IsRegular() {
+			if err := overwrite(w.path(f.Name()), f.Size()); err != nil {
+				fmt.Printf("Failed to overwrite %q: %v\n", f.Name(), err)
+			}
+		}
+	}
+	if err := os.RemoveAll(w.dir); err != nil {
+		return fmt.Errorf("Failed to remove workspace %q: %v", w.dir, err)
+	}
+	return nil
+}
+
+// overwrite replaces the size bytes of the file at path with random data and
+// syncs it to disk.
+func overwrite(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.CopyN(f, rand.Reader, size); err != nil {
+		return err
+	}
+	return f.Sync()
+}
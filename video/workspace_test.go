@@ -0,0 +1,58 @@
+package video
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// TestWorkspaces checks a new workspace leaves the workspaces of this process
+// alone and removes those left behind by processes which have died.
+func TestWorkspaces(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+
+	first, err := newWorkspace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(first.path("image-0.jpeg"), []byte("frame"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// A process which has exited leaves its pid free.
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	stale := filepath.Join(os.TempDir(), workspacePrefix+"stale")
+	if err := os.Mkdir(stale, 0700); err != nil {
+		t.Fatal(err)
+	}
+	pid := []byte(strconv.Itoa(cmd.Process.Pid) + "\n")
+	if err := ioutil.WriteFile(filepath.Join(stale, lockName), pid, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := newWorkspace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(first.path("image-0.jpeg")); err != nil {
+		t.Fatalf("Workspace of this process was removed: %v", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("Stale workspace was not removed: %v", err)
+	}
+
+	for _, w := range []*workspace{first, second} {
+		if err := w.remove(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(w.dir); !os.IsNotExist(err) {
+			t.Fatalf("Workspace %q was not removed: %v", w.dir, err)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package volume
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"stegasis/crypt"
+)
+
+const (
+	// headerSize is the number of bytes reserved for the header at the start
+	// of the embedded data.
+	headerSize = 512
+	// saltSize is the size of the salt which precedes the rest of the header.
+	saltSize = 16
+
+	headerVersion = 3
+	// headerSizes is the number of capacity map entries repeated within the
+	// header, so the map can be located when the first frames are small.
+	headerSizes = 32
+)
+
+var headerMagic = [8]byte{'S', 'T', 'E', 'G', 'A', 'S', 'I', 'S'}
+
+// Header holds the volume header which is embedded at the very start of the
+// video. The header is a random salt followed by the header body, the body is
+// encrypted with a key derived from the passphrase and salt when the volume is
+// encrypted.
+type Header struct {
+	// Alg is the name of the embedding algorithm used for this volume.
+	Alg string
+	// Crypt is the name of the cryptographic algorithm, empty if unencrypted.
+	Crypt string
+	// Cap is the percentage of each frame used for embedding.
+	Cap int
+	// Size is the number of usable bytes following the header and capacity
+	// map.
+	Size int64
+	// Frames is the number of frames the volume was formatted across.
+	Frames int
+	// FirstSizes is the number of bytes embedded within each of the first
+	// frames visited, which hold the header and the start of the capacity map.
+	FirstSizes []int
+
+	salt [saltSize]byte
+	// masterKey is the random key the volume data is encrypted with.
+	masterKey []byte
+	// cipher is the cipher protecting the header and capacity map of
+	// encrypted volumes, nil otherwise.
+	cipher crypt.Cipher
+}
+
+// rawHeader is the on-video layout of the header body.
+type rawHeader struct {
+	Magic      [8]byte
+	Version    uint16
+	Alg        [8]byte
+	Crypt      [24]byte
+	Cap        uint8
+	Size       uint64
+	Frames     uint32
+	FirstSizes [headerSizes]uint32
+	// Verifier holds a hash of the passphrase for unencrypted volumes.
+	Verifier  [sha256.Size]byte
+	MasterKey [192]byte
+}
+
+func passVerifier(salt []byte, pass string) [sha256.Size]byte {
+	return sha256.Sum256(append(append([]byte{}, salt...), pass...))
+}
+
+// headerCipher returns the cipher the header body is encrypted with.
+func headerCipher(name, pass string, salt []byte) (crypt.Cipher, error) {
+	n, err := crypt.KeySize(name)
+	if err != nil {
+		return nil, err
+	}
+	return crypt.New(name, crypt.DeriveKey(pass, salt, n))
+}
+
+// encode encodes the header into exactly headerSize bytes, protected by pass.
+func (h *Header) encode(pass string) ([]byte, error) {
+	raw := rawHeader{
+		Magic:   headerMagic,
+		Version: headerVersion,
+		Cap:     uint8(h.Cap),
+		Size:    uint64(h.Size),
+		Frames:  uint32(h.Frames),
+	}
+	if len(h.Alg) > len(raw.Alg) {
+		return nil, fmt.Errorf("Algorithm name %q is too long", h.Alg)
+	}
+	if len(h.Crypt) > len(raw.Crypt) {
+		return nil, fmt.Errorf("Crypt name %q is too long", h.Crypt)
+	}
+	if len(h.masterKey) > len(raw.MasterKey) {
+		return nil, fmt.Errorf("Master key of %d bytes is too long", len(h.masterKey))
+	}
+	copy(raw.Alg[:], h.Alg)
+	copy(raw.Crypt[:], h.Crypt)
+	copy(raw.MasterKey[:], h.masterKey)
+	for k := 0; k < len(h.FirstSizes) && k < headerSizes; k++ {
+		raw.FirstSizes[k] = uint32(h.FirstSizes[k])
+	}
+	if h.Crypt == "" {
+		raw.Verifier = passVerifier(h.salt[:], pass)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, headerSize))
+	buf.Write(h.salt[:])
+	if err := binary.Write(buf, binary.LittleEndian, &raw); err != nil {
+		return nil, err
+	}
+	b := make([]byte, headerSize)
+	copy(b, buf.Bytes())
+
+	if h.Crypt != "" {
+		c, err := headerCipher(h.Crypt, pass, h.salt[:])
+		if err != nil {
+			return nil, err
+		}
+		c.EncryptSector(b[saltSize:], b[saltSize:], 0)
+		h.cipher = c
+	}
+	return b, nil
+}
+
+// decodeHeader decodes a header previously encoded with encode. cryptName and
+// pass must match those the header was encoded with.
+func decodeHeader(b []byte, cryptName, pass string) (*Header, error) {
+	h := &Header{}
+	copy(h.salt[:], b)
+	body := append([]byte{}, b[saltSize:headerSize]...)
+	if cryptName != "" {
+		c, err := headerCipher(cryptName, pass, h.salt[:])
+		if err != nil {
+			return nil, err
+		}
+		c.DecryptSector(body, body, 0)
+		h.cipher = c
+	}
+
+	var raw rawHeader
+	if err := binary.Read(bytes.NewReader(body), binary.LittleEndian, &raw); err != nil {
+		return nil, fmt.Errorf("Failed to read header: %v", err)
+	}
+	if raw.Magic != headerMagic {
+		if cryptName != "" {
+			return nil, fmt.Errorf("Incorrect passphrase or no stegasis volume found")
+		}
+		return nil, fmt.Errorf("No stegasis volume found")
+	}
+	if raw.Version != headerVersion {
+		return nil, fmt.Errorf("Unsupported volume version %d", raw.Version)
+	}
+
+	h.Alg = string(bytes.TrimRight(raw.Alg[:], "\x00"))
+	h.Crypt = string(bytes.TrimRight(raw.Crypt[:], "\x00"))
+	h.Cap = int(raw.Cap)
+	h.Size = int64(raw.Size)
+	h.Frames = int(raw.Frames)
+	h.FirstSizes = make([]int, headerSizes)
+	for k, n := range raw.FirstSizes {
+		h.FirstSizes[k] = int(n)
+	}
+	if h.Crypt != cryptName {
+		return nil, fmt.Errorf("Volume is encrypted with %q", h.Crypt)
+	}
+	if h.Crypt == "" && passVerifier(h.salt[:], pass) != raw.Verifier {
+		return nil, fmt.Errorf("Incorrect passphrase")
+	}
+	if h.Crypt != "" {
+		n, err := crypt.KeySize(h.Crypt)
+		if err != nil {
+			return nil, err
+		}
+		h.masterKey = raw.MasterKey[:n]
+	}
+	return h, nil
+}
+
+// The capacity map follows the header and holds the number of bytes embedded
+// within each frame, in the order the frames are visited, as a little endian
+// uint32 per frame. The map of an encrypted volume is encrypted with the header
+// cipher, sector 0 being the header itself.
+
+// mapSize returns the space reserved for the capacity map of n frames.
+func mapSize(n int) int64 {
+	return (int64(n)*4 + crypt.SectorSize - 1) / crypt.SectorSize * crypt.SectorSize
+}
+
+// dataOffset returns the offset of the data region, which follows the header
+// and capacity map.
+func (h *Header) dataOffset() int64 {
+	return headerSize + mapSize(h.Frames)
+}
+
+// encodeMap encodes the capacity map, sizes holds the number of bytes within
+// each frame in the order they are visited. encode must be called first.
+func (h *Header) encodeMap(sizes []int) []byte {
+	b := make([]byte, mapSize(len(sizes)))
+	for k, n := range sizes {
+		binary.LittleEndian.PutUint32(b[k*4:], uint32(n))
+	}
+	if h.cipher != nil {
+		for s := 0; s < len(b)/crypt.SectorSize; s++ {
+			sector := b[s*crypt.SectorSize : (s+1)*crypt.SectorSize]
+			h.cipher.EncryptSector(sector, sector, uint64(1+s))
+		}
+	}
+	return b
+}
+
+// decodeMapSector decodes sector s of the capacity map, held in b, into sizes.
+func (h *Header) decodeMapSector(b []byte, s int, sizes []int) {
+	sector := append([]byte{}, b[:crypt.SectorSize]...)
+	if h.cipher != nil {
+		h.cipher.DecryptSector(sector, sector, uint64(1+s))
+	}
+	for j := 0; j < crypt.SectorSize/4; j++ {
+		k := s*crypt.SectorSize/4 + j
+		if k >= len(sizes) {
+			break
+		}
+		sizes[k] = int(binary.LittleEndian.Uint32(sector[j*4:]))
+	}
+}
@@ -0,0 +1,76 @@
+package volume
+
+import (
+	"fmt"
+
+	"stegasis/video"
+)
+
+// A hidden volume lives within the odd frames of the video, which the outer
+// volume visits last and treats as free space, see embedding.FrameOrder. The
+// hidden volume has its own header, keys and frame permutation so without its
+// passphrase it cannot be told apart from the random data the outer volume is
+// filled with.
+
+// hiddenFrame returns true iff frame i of a video is used by the hidden
+// volume.
+func hiddenFrame(i int) bool {
+	return i%2 == 1
+}
+
+// hiddenRange returns the frames of codec used by the hidden volume.
+func hiddenRange(codec video.Codec) video.Codec {
+	return &codecRange{
+		codec:  codec,
+		start:  1,
+		stride: 2,
+		frames: codec.Frames() / 2,
+	}
+}
+
+// codecRange exposes frames frames of an already decoded codec, every strideth
+// frame from start, as a codec of its own. codecRange implements the Codec
+// interface.
+type codecRange struct {
+	codec                 video.Codec
+	start, stride, frames int
+}
+
+// Decode does nothing as the underlying codec is already decoded.
+func (c *codecRange) Decode() error {
+	return nil
+}
+
+// Encode encodes the underlying codec.
+func (c *codecRange) Encode() error {
+	return c.codec.Encode()
+}
+
+// AtomicEncode implements video.AtomicEncoder, the underlying codec encodes
+// every frame.
+func (c *codecRange) AtomicEncode() bool {
+	return video.IsAtomic(c.codec)
+}
+
+// GetFrame returns the ith frame of the range. Panics if i >= Frames() or
+// i < 0.
+func (c *codecRange) GetFrame(i int) (video.Frame, error) {
+	if i < 0 || i >= c.Frames() {
+		panic(fmt.Errorf("GetFrame %d is outside of range of %d frames", i, c.Frames()))
+	}
+	return c.codec.GetFrame(c.start + i*c.stride)
+}
+
+// Frames returns the number of frames within the range.
+func (c *codecRange) Frames() int {
+	return c.frames
+}
+
+// ElementType returns the element type of the underlying codec.
+func (c *codecRange) ElementType() video.ElementType {
+	return c.codec.ElementType()
+}
+
+// Close does nothing, the underlying codec is closed by its owner.
+func (c *codecRange) Close() {
+}
@@ -0,0 +1,444 @@
+// Package volume implements the stegasis volume, a header followed by a
+// contiguous region of data embedded within the frames of a video. The data
+// region is optionally encrypted sector by sector.
+package volume
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+
+	"stegasis/crypt"
+	"stegasis/embedding"
+	"stegasis/video"
+)
+
+// Options holds the options used when formatting a volume.
+type Options struct {
+	// Alg is the name of the embedding algorithm.
+	Alg string
+	// Crypt is the name of the cryptographic algorithm, empty for none.
+	Crypt string
+	// Pass is the passphrase protecting the volume.
+	Pass string
+	// Pass2 is the passphrase protecting the hidden volume, empty for none.
+	Pass2 string
+	// Cap is the percentage of each frame to embed within.
+	Cap int
+}
+
+// Volume provides access to the data region of a volume. Offsets are relative
+// to the end of the header and capacity map. Volume implements io.ReaderAt and
+// io.WriterAt.
+type Volume struct {
+	header *Header
+	dev    *embedding.Device
+	data   crypt.ReadWriterAt
+
+	// hidden is the hidden volume when unlocked with Pass2.
+	hidden *Volume
+	// protected is true iff writes to the frames of the hidden volume are
+	// refused.
+	protected bool
+}
+
+// section is the region of a device which follows the header and capacity
+// map.
+type section struct {
+	dev    *embedding.Device
+	offset int64
+}
+
+// ReadAt implements io.ReaderAt.
+func (s section) ReadAt(p []byte, off int64) (int, error) {
+	return s.dev.ReadAt(p, off+s.offset)
+}
+
+// WriteAt implements io.WriterAt.
+func (s section) WriteAt(p []byte, off int64) (int, error) {
+	return s.dev.WriteAt(p, off+s.offset)
+}
+
+// Format initializes a new volume within the frames of codec, overwriting
+// anything previously embedded. When opts.Pass2 is set a hidden volume is also
+// created within the odd frames, the returned outer volume then refuses writes
+// which would overwrite it. The codec must already be decoded and the caller is
+// responsible for encoding the codec afterwards.
+func Format(codec video.Codec, opts Options) (*Volume, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	v, err := format(codec, opts, opts.Pass)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Pass2 != "" {
+		hidden, err := format(hiddenRange(codec), opts, opts.Pass2)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to format hidden volume: %v", err)
+		}
+		v.protect(hidden)
+	}
+	return v, nil
+}
+
+// format initializes a single volume protected by pass within the frames of
+// codec.
+func format(codec video.Codec, opts Options, pass string) (*Volume, error) {
+	alg, err := newAlgorithm(codec, opts.Alg, embeddingOptions(pass, opts.Cap))
+	if err != nil {
+		return nil, err
+	}
+
+	// Frames hold differing amounts of data depending on their content, the
+	// size of each frame is recorded in the capacity map following the header.
+	sizes, err := embedding.FrameSizes(codec, alg)
+	if err != nil {
+		return nil, err
+	}
+	order := embedding.FrameOrder(alg, codec.Frames())
+	if len(order) == 0 || sizes[order[0]] < headerSize {
+		return nil, fmt.Errorf("Frame capacity is too small for the volume header, try a larger --cap")
+	}
+	visited := make([]int, len(order))
+	for k, i := range order {
+		visited[k] = sizes[i]
+	}
+	end := headerSize + mapSize(len(order))
+	if err := checkMap(visited, end); err != nil {
+		return nil, err
+	}
+	dev := embedding.NewDevice(codec, alg, sizes)
+	if dev.Size() < end+crypt.SectorSize {
+		return nil, fmt.Errorf("Video capacity of %d bytes is too small, try a larger --cap", dev.Size())
+	}
+
+	size := dev.Size() - end
+	h := &Header{
+		Alg:        opts.Alg,
+		Crypt:      opts.Crypt,
+		Cap:        opts.Cap,
+		Size:       size - size%crypt.SectorSize,
+		Frames:     len(order),
+		FirstSizes: visited,
+	}
+	if _, err := rand.Read(h.salt[:]); err != nil {
+		return nil, fmt.Errorf("Failed to generate salt: %v", err)
+	}
+	if opts.Crypt != "" {
+		n, err := crypt.KeySize(opts.Crypt)
+		if err != nil {
+			return nil, err
+		}
+		h.masterKey = make([]byte, n)
+		if _, err := rand.Read(h.masterKey); err != nil {
+			return nil, fmt.Errorf("Failed to generate master key: %v", err)
+		}
+	}
+
+	b, err := h.encode(pass)
+	if err != nil {
+		return nil, err
+	}
+	meta := append(b, h.encodeMap(visited)...)
+
+	// Write every frame so all frames hold valid embedded data, some algorithms
+	// cannot read a frame which has never been written. Frames are filled with
+	// random data, whether or not the volume is encrypted, so the embedded
+	// bits are no more regular than those of an unmodified video and used
+	// sectors cannot be told apart from unused ones. The header and capacity
+	// map are written along with the fill so each frame is written only once,
+	// algorithms which shrink coefficients lose capacity with every write.
+	off := int64(0)
+	for _, n := range visited {
+		fill := make([]byte, n)
+		if _, err := rand.Read(fill); err != nil {
+			return nil, fmt.Errorf("Failed to generate random data: %v", err)
+		}
+		if off < int64(len(meta)) {
+			copy(fill, meta[off:])
+		}
+		if _, err := dev.WriteAt(fill, off); err != nil {
+			return nil, fmt.Errorf("Failed to initialize volume: %v", err)
+		}
+		off += int64(n)
+	}
+	return newVolume(h, dev)
+}
+
+// checkMap returns an error unless a capacity map ending at end can be read
+// back from frames holding the given number of bytes, in the order they are
+// visited. The size of each frame must be read from the frames before it.
+func checkMap(visited []int, end int64) error {
+	known, off := headerSizes, int64(0)
+	for k := 0; off < end; k++ {
+		if k >= known || k >= len(visited) {
+			return fmt.Errorf("Frame capacity is too small for the capacity map, try a larger --cap")
+		}
+		off += int64(visited[k])
+		if n := mapSectors(off) * crypt.SectorSize / 4; n > known {
+			known = n
+		}
+	}
+	return nil
+}
+
+// mapSectors returns the number of whole capacity map sectors held by the
+// first n bytes of a volume.
+func mapSectors(n int64) int {
+	if n < headerSize {
+		return 0
+	}
+	return int((n - headerSize) / crypt.SectorSize)
+}
+
+// readMap reads the capacity map of the volume described by h, returning the
+// number of bytes held by each frame. Frames are read one at a time as the size
+// of each frame is only known once the map sectors before it have been read.
+func readMap(codec video.Codec, alg embedding.Algorithm, h *Header) ([]int, error) {
+	order := embedding.FrameOrder(alg, codec.Frames())
+	visited := make([]int, len(order))
+	copy(visited, h.FirstSizes)
+	known, decoded := headerSizes, 0
+	end := h.dataOffset()
+	buf := make([]byte, 0, end)
+	for k := 0; int64(len(buf)) < end; k++ {
+		if k >= known || k >= len(order) {
+			return nil, fmt.Errorf("Capacity map is corrupt")
+		}
+		f, err := codec.GetFrame(order[k])
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read capacity map: %v", err)
+		}
+		p := make([]byte, visited[k])
+		if err := alg.ReadBits(order[k], f, p); err != nil {
+			return nil, fmt.Errorf("Failed to read capacity map: %v", err)
+		}
+		buf = append(buf, p...)
+		for ; decoded < mapSectors(int64(len(buf))) && headerSize+int64(decoded)*crypt.SectorSize < end; decoded++ {
+			h.decodeMapSector(buf[headerSize+decoded*crypt.SectorSize:], decoded, visited)
+		}
+		if n := decoded * crypt.SectorSize / 4; n > known {
+			known = n
+		}
+	}
+
+	sizes := make([]int, len(order))
+	for k, i := range order {
+		sizes[i] = visited[k]
+	}
+	return sizes, nil
+}
+
+// Open opens a volume previously created with Format within the frames of
+// codec. The codec must already be decoded. Returns an error if opts do not
+// match the options the volume was formatted with.
+//
+// If opts.Pass unlocks a hidden volume rather than the outer volume the hidden
+// volume is returned, so a hidden volume can be used without revealing it
+// exists. If opts.Pass2 is also given the outer volume is returned with the
+// hidden volume protected from being overwritten.
+func Open(codec video.Codec, opts Options) (*Volume, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	v, err := open(codec, opts, opts.Pass)
+	if opts.Pass2 == "" {
+		if err != nil && opts.Crypt != "" {
+			if hidden, herr := open(hiddenRange(codec), opts, opts.Pass); herr == nil {
+				return hidden, nil
+			}
+		}
+		return v, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	hidden, err := open(hiddenRange(codec), opts, opts.Pass2)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open hidden volume: %v", err)
+	}
+	v.protect(hidden)
+	return v, nil
+}
+
+// open opens a single volume protected by pass within the frames of codec.
+func open(codec video.Codec, opts Options, pass string) (*Volume, error) {
+	// The header lives at the start of the first frame visited and algorithms
+	// can read the start of a frame without knowing the capacity the volume
+	// was formatted with.
+	alg, err := newAlgorithm(codec, opts.Alg, embeddingOptions(pass, 100))
+	if err != nil {
+		return nil, err
+	}
+	if codec.Frames() == 0 {
+		return nil, fmt.Errorf("No stegasis volume found")
+	}
+	first := embedding.FrameOrder(alg, codec.Frames())[0]
+	f, err := codec.GetFrame(first)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read header: %v", err)
+	}
+	// Capacity is not checked as algorithms which shrink coefficients report
+	// less than a rewritten frame still holds.
+	b := make([]byte, headerSize)
+	if err := alg.ReadBits(first, f, b); err != nil {
+		return nil, fmt.Errorf("No stegasis volume found")
+	}
+	h, err := decodeHeader(b, opts.Crypt, pass)
+	if err != nil {
+		return nil, err
+	}
+	if h.Alg != opts.Alg {
+		return nil, fmt.Errorf("No stegasis volume found")
+	}
+	if h.Frames != codec.Frames() {
+		return nil, fmt.Errorf("Volume was formatted across %d frames but the video has %d", h.Frames, codec.Frames())
+	}
+
+	alg, err = newAlgorithm(codec, opts.Alg, embeddingOptions(pass, h.Cap))
+	if err != nil {
+		return nil, err
+	}
+	sizes, err := readMap(codec, alg, h)
+	if err != nil {
+		return nil, err
+	}
+	dev := embedding.NewDevice(codec, alg, sizes)
+	if dev.Size() < h.Size+h.dataOffset() {
+		return nil, fmt.Errorf("Volume size %d does not match video capacity %d", h.Size, dev.Size()-h.dataOffset())
+	}
+	return newVolume(h, dev)
+}
+
+// protect refuses writes to v which would overwrite hidden, which lives within
+// the frames given by hiddenRange.
+func (v *Volume) protect(hidden *Volume) {
+	v.hidden = hidden
+	v.protected = true
+}
+
+// newVolume returns a Volume for the data region described by h.
+func newVolume(h *Header, dev *embedding.Device) (*Volume, error) {
+	v := &Volume{
+		header: h,
+		dev:    dev,
+		data:   section{dev, h.dataOffset()},
+	}
+	if h.Crypt != "" {
+		c, err := crypt.New(h.Crypt, h.masterKey)
+		if err != nil {
+			return nil, err
+		}
+		v.data = crypt.NewDevice(v.data, h.Size, c)
+	}
+	return v, nil
+}
+
+// Header returns the volume header.
+func (v *Volume) Header() *Header {
+	return v.header
+}
+
+// Size returns the size of the data region in bytes.
+func (v *Volume) Size() int64 {
+	return v.header.Size
+}
+
+// ReadAt implements io.ReaderAt.
+func (v *Volume) ReadAt(p []byte, off int64) (int, error) {
+	if err := v.checkRange(p, off); err != nil {
+		return 0, err
+	}
+	return v.data.ReadAt(p, off)
+}
+
+// Hidden returns the hidden volume, nil unless the volume was formatted or
+// opened with Pass2.
+func (v *Volume) Hidden() *Volume {
+	return v.hidden
+}
+
+// Protected returns true iff writing n bytes at off would overwrite part of
+// the hidden volume.
+func (v *Volume) Protected(off, n int64) bool {
+	if !v.protected || n <= 0 {
+		return false
+	}
+	// Encrypted writes rewrite every sector they touch.
+	end := off + n
+	off -= off % crypt.SectorSize
+	if r := end % crypt.SectorSize; r != 0 {
+		end += crypt.SectorSize - r
+	}
+	for _, f := range v.dev.Frames(off+v.header.dataOffset(), end-off) {
+		if hiddenFrame(f) {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteAt implements io.WriterAt.
+func (v *Volume) WriteAt(p []byte, off int64) (int, error) {
+	if err := v.checkRange(p, off); err != nil {
+		return 0, err
+	}
+	if v.Protected(off, int64(len(p))) {
+		return 0, fmt.Errorf("Write of %d bytes at %d would overwrite the hidden volume", len(p), off)
+	}
+	return v.data.WriteAt(p, off)
+}
+
+func (v *Volume) checkRange(p []byte, off int64) error {
+	if off < 0 || off+int64(len(p)) > v.header.Size {
+		return fmt.Errorf("Access of %d bytes at %d is outside of volume size %d", len(p), off, v.header.Size)
+	}
+	return nil
+}
+
+// newAlgorithm returns the embedding algorithm name for use with the frames of
+// codec. Algorithms only work with the type of frame element they were designed
+// for, the DCT algorithms would corrupt raw pixels and the pixel algorithms
+// would destroy JPEG frames.
+func newAlgorithm(codec video.Codec, name string, opts embedding.Options) (embedding.Algorithm, error) {
+	alg, err := embedding.New(name, opts)
+	if err != nil {
+		return nil, err
+	}
+	if alg.ElementType() != codec.ElementType() {
+		return nil, fmt.Errorf("Embedding algorithm %q embeds within %v but the frames of this video hold %v", name, alg.ElementType(), codec.ElementType())
+	}
+	return alg, nil
+}
+
+// embeddingOptions returns the options used to create the embedding algorithm
+// for the volume protected by pass. The key is derived without a salt as it is
+// needed before the header can be read.
+func embeddingOptions(pass string, cap int) embedding.Options {
+	key := sha256.Sum256([]byte(pass))
+	return embedding.Options{
+		Key: key[:],
+		Cap: cap,
+	}
+}
+
+func (o Options) validate() error {
+	if o.Crypt != "" {
+		if _, err := crypt.KeySize(o.Crypt); err != nil {
+			return err
+		}
+	}
+	if o.Pass == "" {
+		return fmt.Errorf("A passphrase is required")
+	}
+	if o.Pass2 != "" {
+		if o.Crypt == "" {
+			return fmt.Errorf("Hidden volumes must be encrypted, use --crypt")
+		}
+		if o.Pass2 == o.Pass {
+			return fmt.Errorf("The hidden volume passphrase must differ from the outer volume passphrase")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,337 @@
+package volume
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"stegasis/crypt"
+	"stegasis/embedding"
+	"stegasis/video"
+	"stegasis/video/videotest"
+)
+
+// randomBytes returns n bytes from r.
+func randomBytes(r *rand.Rand, n int64) []byte {
+	p := make([]byte, n)
+	r.Read(p)
+	return p
+}
+
+// readAll returns the whole data region of v.
+func readAll(t *testing.T, v *Volume) []byte {
+	p := make([]byte, v.Size())
+	if _, err := v.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// TestElementType checks every algorithm can only format and open volumes
+// within frames of the element type it embeds within.
+func TestElementType(t *testing.T) {
+	for _, alg := range embedding.Names() {
+		opts := Options{Alg: alg, Pass: "pass", Cap: 100}
+		for _, typ := range []video.ElementType{video.Pixels, video.DCTCoefficients} {
+			c := videotest.NewCodec(1, typ, videotest.Sizes(8, 32768)...)
+			a, err := embedding.New(alg, embedding.Options{Cap: 100})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = Format(c, opts)
+			if match := a.ElementType() == typ; match != (err == nil) {
+				t.Errorf("%s: Format within %v: %v", alg, typ, err)
+			}
+		}
+
+		// Mounting must be refused the same way, the codec given to Open
+		// reports the other element type.
+		a, _ := embedding.New(alg, embedding.Options{Cap: 100})
+		c := videotest.NewCodec(2, a.ElementType(), videotest.Sizes(8, 32768)...)
+		if _, err := Format(c, opts); err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		if _, err := Open(c, opts); err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		c.Type = video.Pixels + video.DCTCoefficients - c.Type
+		if _, err := Open(c, opts); err == nil {
+			t.Errorf("%s: Open within %v did not fail", alg, c.Type)
+		}
+	}
+}
+
+// TestHidden formats a volume with a hidden volume and opens it every way a
+// hidden volume can be opened. Filling the outer volume while the hidden volume
+// is protected must leave the hidden volume intact.
+func TestHidden(t *testing.T) {
+	c := videotest.NewCodec(3, video.Pixels, videotest.Sizes(16, 32768)...)
+	opts := Options{Alg: "lsbp", Crypt: "aes", Pass: "outer", Pass2: "hidden", Cap: 100}
+	v, err := Format(c, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hidden := v.Hidden()
+	if hidden == nil {
+		t.Fatal("Format with Pass2 did not create a hidden volume")
+	}
+	r := rand.New(rand.NewSource(4))
+	secret := randomBytes(r, hidden.Size())
+	if _, err := hidden.WriteAt(secret, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	outer, err := Open(c, Options{Alg: "lsbp", Crypt: "aes", Pass: "outer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outer.Hidden() != nil || outer.Size() != v.Size() || outer.Protected(0, outer.Size()) {
+		t.Fatal("Open with Pass did not open the unprotected outer volume")
+	}
+
+	h, err := Open(c, Options{Alg: "lsbp", Crypt: "aes", Pass: "hidden"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Size() != hidden.Size() || !bytes.Equal(readAll(t, h), secret) {
+		t.Fatal("Open with the hidden passphrase did not open the hidden volume")
+	}
+
+	both, err := Open(c, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if both.Hidden() == nil || both.Size() != v.Size() {
+		t.Fatal("Open with Pass and Pass2 did not open the outer volume")
+	}
+	if both.Protected(0, crypt.SectorSize) || !both.Protected(0, both.Size()) {
+		t.Fatal("Only the end of the outer volume must be protected")
+	}
+	want := readAll(t, both)
+	for off := int64(0); off < both.Size(); off += crypt.SectorSize {
+		p := randomBytes(r, crypt.SectorSize)
+		_, err := both.WriteAt(p, off)
+		if both.Protected(off, crypt.SectorSize) {
+			if err == nil {
+				t.Fatalf("Write at %d over the hidden volume did not fail", off)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		copy(want[off:], p)
+	}
+	if !bytes.Equal(readAll(t, both), want) {
+		t.Fatal("Outer volume does not hold the data written")
+	}
+	if h, err = Open(c, Options{Alg: "lsbp", Crypt: "aes", Pass: "hidden"}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readAll(t, h), secret) {
+		t.Fatal("Filling the outer volume overwrote the hidden volume")
+	}
+}
+
+// TestHiddenOptions checks hidden volumes must be encrypted and have their own
+// passphrase.
+func TestHiddenOptions(t *testing.T) {
+	for _, opts := range []Options{
+		{Alg: "lsb", Pass: "outer", Pass2: "hidden", Cap: 100},
+		{Alg: "lsb", Crypt: "aes", Pass: "same", Pass2: "same", Cap: 100},
+	} {
+		c := videotest.NewCodec(5, video.Pixels, videotest.Sizes(8, 32768)...)
+		if _, err := Format(c, opts); err == nil {
+			t.Errorf("Format with %+v did not fail", opts)
+		}
+	}
+	c := videotest.NewCodec(5, video.Pixels, videotest.Sizes(8, 32768)...)
+	if _, err := Format(c, Options{Alg: "lsb", Crypt: "aes", Pass: "outer", Cap: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(c, Options{Alg: "lsb", Crypt: "aes", Pass: "outer", Pass2: "hidden"}); err == nil {
+		t.Error("Open with Pass2 of a volume without a hidden volume did not fail")
+	}
+}
+
+// TestCapacityMap formats volumes across frames of random sizes and checks the
+// capacity map read back on open matches the capacity of every frame.
+func TestCapacityMap(t *testing.T) {
+	for _, cryptName := range []string{"", "aes"} {
+		r := rand.New(rand.NewSource(6))
+		sizes := videotest.Sizes(40, 0)
+		for i := range sizes {
+			sizes[i] = 8 * (512 + r.Intn(2048))
+		}
+		c := videotest.NewCodec(7, video.Pixels, sizes...)
+		opts := Options{Alg: "lsbp", Crypt: cryptName, Pass: "pass", Cap: 60}
+		if _, err := Format(c, opts); err != nil {
+			t.Fatalf("%q: %v", cryptName, err)
+		}
+		alg, err := embedding.New(opts.Alg, embeddingOptions(opts.Pass, opts.Cap))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := embedding.FrameSizes(c, alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := Open(c, opts)
+		if err != nil {
+			t.Fatalf("%q: %v", cryptName, err)
+		}
+		got, err := readMap(c, alg, v.Header())
+		if err != nil {
+			t.Fatalf("%q: %v", cryptName, err)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("%q: capacity map holds %d bytes for frame %d, want %d", cryptName, got[i], i, want[i])
+			}
+		}
+	}
+}
+
+// TestSmallFrames formats a volume whose capacity map spans more frames than
+// the header holds the sizes of, so the map must be read a sector at a time.
+// Frames too small to hold the map at all must be refused.
+func TestSmallFrames(t *testing.T) {
+	for _, cryptName := range []string{"", "aes"} {
+		// The first frame holds little more than the header, the map of 1000
+		// frames then spans 64 frames of 64 bytes.
+		sizes := append([]int{8 * 520}, videotest.Sizes(999, 8*64)...)
+		c := videotest.NewCodec(8, video.Pixels, sizes...)
+		opts := Options{Alg: "lsb", Crypt: cryptName, Pass: "pass", Cap: 100}
+		v, err := Format(c, opts)
+		if err != nil {
+			t.Fatalf("%q: %v", cryptName, err)
+		}
+		if n := mapSize(len(sizes)) / 64; n <= headerSizes {
+			t.Fatalf("Capacity map spans %d frames, only the header is read", n)
+		}
+		r := rand.New(rand.NewSource(9))
+		want := randomBytes(r, v.Size())
+		if _, err := v.WriteAt(want, 0); err != nil {
+			t.Fatal(err)
+		}
+		if v, err = Open(c, opts); err != nil {
+			t.Fatalf("%q: %v", cryptName, err)
+		}
+		if !bytes.Equal(readAll(t, v), want) {
+			t.Fatalf("%q: volume does not hold the data written", cryptName)
+		}
+	}
+
+	sizes := append([]int{8 * 512}, videotest.Sizes(999, 8*8)...)
+	c := videotest.NewCodec(10, video.Pixels, sizes...)
+	if _, err := Format(c, Options{Alg: "lsb", Pass: "pass", Cap: 100}); err == nil {
+		t.Error("Format with frames too small for the capacity map did not fail")
+	}
+}
+
+func TestCheckMap(t *testing.T) {
+	tests := []struct {
+		visited []int
+		end     int64
+		ok      bool
+	}{
+		{[]int{headerSize + 512}, headerSize + 512, true},
+		{[]int{headerSize, 256, 256}, headerSize + 512, true},
+		{[]int{headerSize, 256}, headerSize + 512, false},
+		// Once the first map sector has been read the sizes of 128 frames are
+		// known, beyond the sizes held by the header.
+		{append([]int{headerSize}, videotest.Sizes(32, 32)...), headerSize + 1024, true},
+		{append([]int{headerSize}, videotest.Sizes(31, 32)...), headerSize + 1024, false},
+		{append([]int{headerSize}, videotest.Sizes(80, 8)...), headerSize + 512, false},
+	}
+	for _, test := range tests {
+		if err := checkMap(test.visited, test.end); (err == nil) != test.ok {
+			t.Errorf("checkMap of %d frames ending at %d: %v", len(test.visited), test.end, err)
+		}
+	}
+}
+
+// TestHeader encodes and decodes headers of unencrypted volumes and volumes
+// encrypted with every cipher.
+func TestHeader(t *testing.T) {
+	for _, cryptName := range append([]string{""}, crypt.Names()...) {
+		h := &Header{
+			Alg:        "dctp",
+			Crypt:      cryptName,
+			Cap:        40,
+			Size:       123 * crypt.SectorSize,
+			Frames:     250,
+			FirstSizes: videotest.Sizes(headerSizes, 1000),
+		}
+		rand.New(rand.NewSource(11)).Read(h.salt[:])
+		if cryptName != "" {
+			n, err := crypt.KeySize(cryptName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.masterKey = randomBytes(rand.New(rand.NewSource(12)), int64(n))
+		}
+		b, err := h.encode("pass")
+		if err != nil {
+			t.Fatalf("%q: %v", cryptName, err)
+		}
+		if len(b) != headerSize {
+			t.Fatalf("%q: header is %d bytes, want %d", cryptName, len(b), headerSize)
+		}
+		got, err := decodeHeader(b, cryptName, "pass")
+		if err != nil {
+			t.Fatalf("%q: %v", cryptName, err)
+		}
+		if got.Alg != h.Alg || got.Crypt != h.Crypt || got.Cap != h.Cap || got.Size != h.Size || got.Frames != h.Frames || got.salt != h.salt {
+			t.Fatalf("%q: decoded %+v, want %+v", cryptName, got, h)
+		}
+		for k := range h.FirstSizes {
+			if got.FirstSizes[k] != h.FirstSizes[k] {
+				t.Fatalf("%q: decoded first size %d of %d, want %d", cryptName, k, got.FirstSizes[k], h.FirstSizes[k])
+			}
+		}
+		if !bytes.Equal(got.masterKey, h.masterKey) {
+			t.Fatalf("%q: decoded master key does not match", cryptName)
+		}
+	}
+}
+
+// TestOpenRejects checks volumes are only opened with the options they were
+// formatted with.
+func TestOpenRejects(t *testing.T) {
+	for _, cryptName := range []string{"", "aes"} {
+		c := videotest.NewCodec(13, video.Pixels, videotest.Sizes(8, 32768)...)
+		opts := Options{Alg: "lsb", Crypt: cryptName, Pass: "pass", Cap: 100}
+		if _, err := Format(c, opts); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Open(c, opts); err != nil {
+			t.Fatalf("%q: %v", cryptName, err)
+		}
+
+		wrong := []Options{
+			{Alg: "lsb", Crypt: cryptName, Pass: "wrong"},
+			{Alg: "lsbp", Crypt: cryptName, Pass: "pass"},
+			{Alg: "lsb", Crypt: "twofish", Pass: "pass"},
+		}
+		if cryptName != "" {
+			wrong = append(wrong, Options{Alg: "lsb", Pass: "pass"})
+		}
+		for _, o := range wrong {
+			if _, err := Open(c, o); err == nil {
+				t.Errorf("%q: Open with %+v did not fail", cryptName, o)
+			}
+		}
+
+		// Invalid options are rejected before the video is read.
+		for _, o := range []Options{
+			{Alg: "lsb", Crypt: cryptName},
+			{Alg: "lsb", Crypt: "rot13", Pass: "pass"},
+		} {
+			want := o.validate()
+			if _, err := Open(c, o); want == nil || err == nil || err.Error() != want.Error() {
+				t.Errorf("%q: Open with %+v failed with %v, expected %v", cryptName, o, err, want)
+			}
+		}
+	}
+}